@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 记录每个来源 IP 当前的连接数，accept 循环和各个连接的 goroutine 都会访问，需要加锁
+var (
+	connsPerIP = make(map[string]int)
+	connsMutex sync.Mutex
+)
+
+// 记录每个来源 IP 最近的连接时间，以及因重连过于频繁被拒绝到什么时候
+var (
+	reconnects     = make(map[string]*reconnectState)
+	reconnectMutex sync.Mutex
+)
+
+type reconnectState struct {
+	attempts     []time.Time
+	blockedUntil time.Time
+}
+
+// snapshotConnsPerIP 返回每个 IP 当前连接数的拷贝，供 /debug 查看
+func snapshotConnsPerIP() map[string]int {
+	connsMutex.Lock()
+	defer connsMutex.Unlock()
+	counts := make(map[string]int, len(connsPerIP))
+	for ip, n := range connsPerIP {
+		counts[ip] = n
+	}
+	return counts
+}
+
+// snapshotCooldowns 返回因重连过于频繁仍被拒绝的 IP 及剩余时间，供 /debug 查看
+func snapshotCooldowns(now time.Time) map[string]string {
+	reconnectMutex.Lock()
+	defer reconnectMutex.Unlock()
+	cooldowns := make(map[string]string)
+	for ip, state := range reconnects {
+		if left := state.blockedUntil.Sub(now); left > 0 {
+			cooldowns[ip] = left.Round(time.Second).String()
+		}
+	}
+	return cooldowns
+}
+
+// parseCIDRs 解析逗号分隔的 CIDR 列表，空字符串返回 nil
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP 从连接的远端地址中解析出 IP，非 IP 地址（如 unix socket）返回 nil
+func remoteIP(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// checkCIDR 按黑白名单检查来源 IP，允许时返回空字符串，否则返回拒绝原因
+// 黑名单优先于白名单
+func checkCIDR(ip net.IP) string {
+	if len(denyCIDRs) == 0 && len(allowCIDRs) == 0 {
+		return ""
+	}
+	if ip == nil {
+		return "无法解析来源 IP"
+	}
+	if containsIP(denyCIDRs, ip) {
+		return fmt.Sprintf("%s 命中 DENY_CIDRS", ip)
+	}
+	if len(allowCIDRs) > 0 && !containsIP(allowCIDRs, ip) {
+		return fmt.Sprintf("%s 不在 ALLOW_CIDRS 中", ip)
+	}
+	return ""
+}
+
+// acquireConn 为来源 IP 占用一个连接名额，超过 maxConnsPerIP 时返回 false
+// 无法解析出 IP 的连接不做限制
+func acquireConn(ip net.IP) bool {
+	if ip == nil || maxConnsPerIP <= 0 {
+		return true
+	}
+
+	connsMutex.Lock()
+	defer connsMutex.Unlock()
+
+	key := ip.String()
+	if connsPerIP[key] >= maxConnsPerIP {
+		return false
+	}
+	connsPerIP[key]++
+	return true
+}
+
+// releaseConn 连接断开时归还 acquireConn 占用的名额
+func releaseConn(ip net.IP) {
+	if ip == nil || maxConnsPerIP <= 0 {
+		return
+	}
+
+	connsMutex.Lock()
+	defer connsMutex.Unlock()
+
+	key := ip.String()
+	if connsPerIP[key]--; connsPerIP[key] <= 0 {
+		delete(connsPerIP, key)
+	}
+}
+
+// allowReconnect 按滑动窗口检查来源 IP 的连接频率，RECONNECT_WINDOW 内超过 RECONNECT_LIMIT 次时，
+// 在 RECONNECT_COOLDOWN 内拒绝该 IP 的所有新连接，避免有问题的客户端不停重连
+// 无法解析出 IP 的连接不做限制
+func allowReconnect(ip net.IP, now time.Time) bool {
+	if ip == nil || reconnectLimit <= 0 {
+		return true
+	}
+
+	reconnectMutex.Lock()
+	defer reconnectMutex.Unlock()
+
+	key := ip.String()
+	st := reconnects[key]
+	if st == nil {
+		st = &reconnectState{}
+		reconnects[key] = st
+	}
+	if now.Before(st.blockedUntil) {
+		return false
+	}
+	st.attempts = append(pruneAttempts(st.attempts, now), now)
+	if len(st.attempts) > reconnectLimit {
+		warnf("%s 在 %v 内连接了 %d 次，%v 内拒绝新连接", key, reconnectWindow, len(st.attempts), reconnectCooldown)
+		st.blockedUntil = now.Add(reconnectCooldown)
+		st.attempts = nil
+		return false
+	}
+	return true
+}
+
+// pruneAttempts 去掉滑动窗口之外的连接记录
+func pruneAttempts(attempts []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-reconnectWindow)
+	i := 0
+	for i < len(attempts) && attempts[i].Before(cutoff) {
+		i++
+	}
+	return attempts[i:]
+}
+
+// cleanupReconnects 定期删除窗口内没有连接、也不在冷却期的 IP，避免记录无限增长
+func cleanupReconnects() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		reconnectMutex.Lock()
+		for key, st := range reconnects {
+			st.attempts = pruneAttempts(st.attempts, now)
+			if len(st.attempts) == 0 && !now.Before(st.blockedUntil) {
+				delete(reconnects, key)
+			}
+		}
+		reconnectMutex.Unlock()
+	}
+}
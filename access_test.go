@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckCIDR(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow string
+		deny  string
+		ip    string
+		ok    bool
+	}{
+		{"未配置时全部允许", "", "", "203.0.113.5", true},
+		{"未配置时无法解析的地址也允许", "", "", "", true},
+		{"命中白名单", "10.0.0.0/8,192.168.1.0/24", "", "192.168.1.20", true},
+		{"不在白名单中", "10.0.0.0/8", "", "192.168.1.20", false},
+		{"命中黑名单", "", "203.0.113.0/24", "203.0.113.5", false},
+		{"不在黑名单中", "", "203.0.113.0/24", "198.51.100.1", true},
+		{"黑名单优先于白名单", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.3", false},
+		{"白名单中未被拉黑的地址", "10.0.0.0/8", "10.1.0.0/16", "10.2.0.1", true},
+		{"IPv6 白名单", "2001:db8::/32", "", "2001:db8::1", true},
+		{"IPv4 地址不匹配 IPv6 白名单", "2001:db8::/32", "", "10.0.0.1", false},
+		{"配置了名单时拒绝无法解析的地址", "10.0.0.0/8", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allow, err := parseCIDRs(tt.allow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			deny, err := parseCIDRs(tt.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setConfig(t, &allowCIDRs, allow)
+			setConfig(t, &denyCIDRs, deny)
+
+			reason := checkCIDR(net.ParseIP(tt.ip))
+			if (reason == "") != tt.ok {
+				t.Errorf("checkCIDR(%q) = %q，期望允许 = %v", tt.ip, reason, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs(" 10.0.0.0/8, ,192.168.0.0/16 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 2 {
+		t.Errorf("解析出 %d 个网段，期望 2 个", len(nets))
+	}
+	if _, err := parseCIDRs("10.0.0.0/8,not-a-cidr"); err == nil {
+		t.Error("格式错误的条目没有返回错误")
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	for addr, want := range map[string]string{
+		"203.0.113.5:2020": "203.0.113.5",
+		"[2001:db8::1]:80": "2001:db8::1",
+		"198.51.100.7":     "198.51.100.7",
+	} {
+		if got := remoteIP(pipeAddr(addr)); !got.Equal(net.ParseIP(want)) {
+			t.Errorf("remoteIP(%q) = %v，期望 %v", addr, got, want)
+		}
+	}
+	if got := remoteIP(pipeAddr("pipe")); got != nil {
+		t.Errorf("remoteIP(pipe) = %v，期望 nil", got)
+	}
+}
+
+func TestDeniedConnectionClosed(t *testing.T) {
+	deny, _ := parseCIDRs("203.0.113.0/24")
+	setConfig(t, &denyCIDRs, deny)
+	ts := startServer(t)
+
+	// 在登记之前直接断开，连昵称提示都不会发送
+	if lines := ts.connect("203.0.113.5:40000").expectClosed(); len(lines) != 0 {
+		t.Errorf("被拒绝的连接收到了 %q", lines)
+	}
+	ts.connect("198.51.100.1:40000").expect("请输入你的昵称")
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	setConfig(t, &maxConnsPerIP, 3)
+	// 只测试同时在线的连接数，不让重连频率限制干扰
+	setConfig(t, &reconnectLimit, 0)
+	ts := startServer(t)
+
+	const addr = "198.51.100.9:"
+	var clients []*testClient
+	for i := 0; i < 3; i++ {
+		c := ts.connect(addr + strconv.Itoa(40000+i))
+		c.expect("请输入你的昵称")
+		clients = append(clients, c)
+	}
+	clients[0].send("alice")
+	clients[0].expect("欢迎你的到来")
+
+	// 第 4 个连接在登记之前就被拒绝，其他 IP 不受影响
+	if lines := ts.connect(addr + "40003").expectClosed(); len(lines) != 1 || lines[0] != "来自你 IP 的连接过多" {
+		t.Errorf("超出上限的连接收到 %q", lines)
+	}
+	ts.connect("198.51.100.10:40000").expect("请输入你的昵称")
+
+	// 已进入和未进入聊天室的连接断开后都会归还名额
+	for _, c := range clients {
+		c.close()
+	}
+	for i := 0; i < 3; i++ {
+		eventuallyConnect(t, ts, addr+strconv.Itoa(40010+i))
+	}
+}
+
+// eventuallyConnect 反复尝试从 addr 建立连接，直到收到昵称提示
+// 连接断开后名额在连接的 goroutine 退出时才归还，和客户端看到断开之间没有先后保证
+func eventuallyConnect(t *testing.T, ts *testServer, addr string) *testClient {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		c := ts.connect(addr)
+		lines := c.collect(50 * time.Millisecond)
+		if len(lines) > 0 && strings.Contains(lines[0], "请输入你的昵称") {
+			return c
+		}
+		c.close()
+		if time.Now().After(deadline) {
+			t.Fatalf("%s 的名额没有归还，收到 %q", addr, lines)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// report 用户举报，由 broadcaster 转发给在线的管理员
+type report struct {
+	From   *User
+	Target string
+	Reason string
+	Time   time.Time
+}
+
+func (r *report) String() string {
+	return "[举报] " + r.Time.Format("15:04") + " " + r.From.NickName + " 举报了 " + r.Target + "：" + r.Reason
+}
+
+// checkAdminPassword 校验管理员密码，未配置 ADMIN_PASSWORD 时不允许任何人成为管理员
+func checkAdminPassword(password string) bool {
+	if adminPassword == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(adminPassword)) == 1
+}
+
+// requireAdmin 检查用户是否为管理员，不是时回复提示并返回 false
+func requireAdmin(user *User) bool {
+	if !user.IsAdmin.Load() {
+		user.notify("该命令需要管理员权限")
+		return false
+	}
+	return true
+}
+
+// adminCommand 使用管理员密码获取管理员权限
+// 用法：/admin <密码>
+func adminCommand(user *User, password string) {
+	if user.IsAdmin.Load() {
+		user.notify("你已经是管理员")
+		return
+	}
+	if !checkAdminPassword(password) {
+		audit(user.Addr, "auth-failed", user.NickName)
+		user.notify("管理员密码错误")
+		return
+	}
+	audit(user.Addr, "admin", user.NickName)
+	submit(user.srv, user.srv.adminChannel, user)
+}
+
+// handleAdmin 在 broadcaster 中将用户设为管理员，并转交尚未处理的举报
+func handleAdmin(user *User, pendingReports *[]*report) {
+	user.IsAdmin.Store(true)
+	user.tell("已获得管理员权限")
+
+	if len(*pendingReports) == 0 {
+		return
+	}
+	// 合成一条提示，暂存的举报再多也只占发送队列的一个位置
+	var b strings.Builder
+	b.WriteString("有 " + strconv.Itoa(len(*pendingReports)) + " 条待处理的举报：")
+	for _, r := range *pendingReports {
+		b.WriteString("\n" + r.String())
+	}
+	user.tell(b.String())
+	*pendingReports = nil
+}
+
+// handleReport 在 broadcaster 中把举报转发给所有在线管理员，没有管理员在线时暂存，
+// 交给下一个获得管理员权限的用户
+func handleReport(users map[*User]struct{}, r *report, pendingReports *[]*report) {
+	notified := 0
+	for user := range users {
+		if user.IsAdmin.Load() {
+			user.tell(r.String())
+			notified++
+		}
+	}
+
+	if notified > 0 {
+		r.From.tell("举报已提交给 " + strconv.Itoa(notified) + " 位管理员")
+		return
+	}
+	if reportQueueSize <= 0 {
+		r.From.tell("当前没有管理员在线，请稍后再试")
+		return
+	}
+	if len(*pendingReports) >= reportQueueSize {
+		// 丢弃最早的举报，保留最新的
+		*pendingReports = (*pendingReports)[1:]
+	}
+	*pendingReports = append(*pendingReports, r)
+	r.From.tell("当前没有管理员在线，举报将在管理员上线后送达")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEvent 审计日志中的一条记录
+type auditEvent struct {
+	Time   time.Time
+	Actor  string
+	Action string
+	Detail string
+}
+
+// 审计日志只记录安全相关的事件（连接、昵称、踢人、封禁、认证失败、管理员命令等），
+// 与普通运行日志分开写入独立文件。未配置 AUDIT_LOG 时为 nil，不记录
+var auditChannel chan auditEvent
+
+// auditMutex 保护 stopAudit 对 auditChannel 的关闭：关闭服务超时后仍可能有连接在记录事件，不能向已关闭的 channel 发送
+var auditMutex sync.RWMutex
+
+// auditDone 写入 goroutine 写完剩余事件、关闭文件后关闭
+var auditDone chan struct{}
+
+// startAudit 打开审计日志文件并启动写入 goroutine
+func startAudit(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	auditChannel = make(chan auditEvent, 256)
+	auditDone = make(chan struct{})
+	go auditWriter(f, auditChannel)
+	return nil
+}
+
+// stopAudit 停止记录，等写入 goroutine 写完缓冲中的事件并关闭文件后返回，未启动时直接返回
+func stopAudit() {
+	auditMutex.Lock()
+	ch := auditChannel
+	auditChannel = nil
+	auditMutex.Unlock()
+	if ch == nil {
+		return
+	}
+	close(ch)
+	<-auditDone
+}
+
+// audit 记录一条审计事件，从不阻塞调用方：缓冲满时丢弃并写入普通日志
+func audit(actor, action, detail string) {
+	auditMutex.RLock()
+	defer auditMutex.RUnlock()
+	if auditChannel == nil {
+		return
+	}
+
+	select {
+	case auditChannel <- auditEvent{Time: time.Now(), Actor: actor, Action: action, Detail: detail}:
+	default:
+		warnf("审计日志缓冲已满，丢弃事件：%s %s %s", actor, action, detail)
+	}
+}
+
+func auditWriter(f *os.File, events chan auditEvent) {
+	defer close(auditDone)
+	defer func() {
+		if err := f.Sync(); err != nil {
+			errorf("写入审计日志失败：%v", err)
+		}
+		if err := f.Close(); err != nil {
+			errorf("关闭审计日志失败：%v", err)
+		}
+	}()
+
+	for e := range events {
+		_, err := fmt.Fprintf(f, "%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Actor, e.Action, e.Detail)
+		if err != nil {
+			errorf("写入审计日志失败：%v", err)
+			continue
+		}
+		// 暂时没有更多事件时落盘，避免进程异常退出丢失记录
+		if len(events) == 0 {
+			f.Sync()
+		}
+	}
+}
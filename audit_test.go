@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStopAuditFlushes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := startAudit(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		audit("1.2.3.4:5678", "connect", strconv.Itoa(i))
+	}
+	stopAudit()
+	// 停止之后仍在退出的连接记录事件时直接忽略
+	audit("1.2.3.4:5678", "disconnect", "")
+	stopAudit()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\tconnect\t"); n != 100 {
+		t.Errorf("审计日志中有 %d 条记录，期望 100 条", n)
+	}
+	if strings.Contains(string(data), "disconnect") {
+		t.Error("停止后记录的事件被写入审计日志")
+	}
+}
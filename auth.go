@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Authenticator 进入聊天室时的身份认证，在昵称确定之后、登记之前调用
+// 使用重连令牌找回会话时不再认证
+type Authenticator interface {
+	// NeedsCredential 是否需要客户端提供凭证，为 false 时不会提示输入
+	NeedsCredential() bool
+	// Authenticate 校验昵称和凭证，返回是否允许进入，以及是否直接成为管理员
+	Authenticate(nick, credential string) (allowed, admin bool)
+	// PerNick 凭证是否按昵称区分，为 true 时认证通过就能确认用户是这个昵称的主人
+	PerNick() bool
+}
+
+// 当前使用的认证方式，由 AUTH 配置选择
+var authenticator Authenticator = noopAuth{}
+
+// noopAuth 不认证，任何人都可以进入（默认）
+type noopAuth struct{}
+
+func (noopAuth) NeedsCredential() bool { return false }
+
+func (noopAuth) Authenticate(nick, credential string) (bool, bool) { return true, false }
+
+func (noopAuth) PerNick() bool { return false }
+
+// passwordAuth 所有人共用一个密码
+type passwordAuth struct {
+	password string
+}
+
+func (passwordAuth) NeedsCredential() bool { return true }
+
+func (passwordAuth) PerNick() bool { return false }
+
+func (a passwordAuth) Authenticate(nick, credential string) (bool, bool) {
+	return subtle.ConstantTimeCompare([]byte(credential), []byte(a.password)) == 1, false
+}
+
+// fileAuth 每个昵称单独的密码，从文件读取，每行一条 "昵称:密码"，
+// 末尾加上 ":admin" 表示该用户进入后直接成为管理员；空行和 # 开头的行忽略
+type fileAuth struct {
+	accounts map[string]account
+}
+
+type account struct {
+	password string
+	admin    bool
+}
+
+func (fileAuth) NeedsCredential() bool { return true }
+
+func (fileAuth) PerNick() bool { return true }
+
+func (a fileAuth) Authenticate(nick, credential string) (bool, bool) {
+	acc, ok := a.accounts[nick]
+	if !ok || subtle.ConstantTimeCompare([]byte(credential), []byte(acc.password)) != 1 {
+		return false, false
+	}
+	return true, acc.admin
+}
+
+// loadFileAuth 读取账号文件
+func loadFileAuth(path string) (fileAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileAuth{}, err
+	}
+	defer f.Close()
+
+	accounts := make(map[string]account)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || (len(parts) == 3 && parts[2] != "admin") {
+			return fileAuth{}, fmt.Errorf("%s 第 %d 行格式错误，应为 昵称:密码[:admin]", path, lineNo)
+		}
+		accounts[parts[0]] = account{password: parts[1], admin: len(parts) == 3}
+	}
+	if err := scanner.Err(); err != nil {
+		return fileAuth{}, err
+	}
+	return fileAuth{accounts: accounts}, nil
+}
+
+// newAuthenticator 根据配置创建认证方式：none（默认）、password（AUTH_PASSWORD）或 file（AUTH_FILE）
+func newAuthenticator(mode, password, path string) (Authenticator, error) {
+	switch mode {
+	case "", "none":
+		return noopAuth{}, nil
+	case "password":
+		if password == "" {
+			return nil, fmt.Errorf("AUTH=password 时需要设置 AUTH_PASSWORD")
+		}
+		return passwordAuth{password: password}, nil
+	case "file":
+		return loadFileAuth(path)
+	default:
+		return nil, fmt.Errorf("未知的认证方式 AUTH=%q", mode)
+	}
+}
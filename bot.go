@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"time"
+)
+
+// botRule 关键词及对应的自动回复
+type botRule struct {
+	Keyword  string
+	Response string
+}
+
+// greetingBot 关键词自动回复机器人，作为伪用户运行在 broadcaster 中
+type greetingBot struct {
+	rules     []botRule
+	lastReply time.Time
+}
+
+// loadBotRules 从文件读取关键词规则，每行一条，格式为 "关键词=回复"，# 开头的行为注释
+func loadBotRules(path string) ([]botRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []botRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyword, response, ok := strings.Cut(line, "=")
+		keyword, response = strings.TrimSpace(keyword), strings.TrimSpace(response)
+		if !ok || keyword == "" || response == "" {
+			warnf("%s：忽略格式错误的规则 %q", path, line)
+			continue
+		}
+		rules = append(rules, botRule{Keyword: strings.ToLower(keyword), Response: response})
+	}
+	return rules, scanner.Err()
+}
+
+// reply 返回对该消息的自动回复，不需要回复时返回 nil
+// 不回复系统消息、机器人自己的消息，以及在握手元数据中声明了 capabilities: bot 的客户端发送的消息，
+// 两次回复之间至少间隔 botCooldown，避免刷屏和互相触发
+func (b *greetingBot) reply(msg *Message) *Message {
+	if msg.Kind != KindChat || msg.Bot || msg.From == botName {
+		return nil
+	}
+	if msg.sender != nil && msg.sender.hasCapability("bot") {
+		return nil
+	}
+	if time.Since(b.lastReply) < botCooldown {
+		return nil
+	}
+
+	text := strings.ToLower(msg.Content)
+	for _, rule := range b.rules {
+		if strings.Contains(text, rule.Keyword) {
+			b.lastReply = time.Now()
+			reply := newMessage(botName, rule.Response)
+			reply.Bot = true
+			return reply
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import "strconv"
+
+// capacityRequest 查询或设置聊天室的人数上限，Set 为 false 时只查询
+type capacityRequest struct {
+	User *User
+	Set  bool
+	Max  int
+}
+
+// capacityCommand 处理 /capacity [n]，查询任何人都可以，设置需要管理员权限
+func capacityCommand(user *User, args string) {
+	if args == "" {
+		submit(user.srv, user.srv.capacityChannel, capacityRequest{User: user})
+		return
+	}
+	if !requireAdmin(user) {
+		return
+	}
+	n, err := strconv.Atoi(args)
+	if err != nil || n < 0 {
+		user.notify("用法：/capacity [人数]，0 表示不限制")
+		return
+	}
+	submit(user.srv, user.srv.capacityChannel, capacityRequest{User: user, Set: true, Max: n})
+}
+
+// handleCapacity 在 broadcaster 中查询或设置人数上限，返回新的上限
+// 调低到当前在线人数以下时不会断开任何人，只是在人数降下来之前不再允许新用户进入
+func handleCapacity(users map[*User]struct{}, capacity int, req capacityRequest) int {
+	if req.Set {
+		capacity = req.Max
+		audit(req.User.Addr, "capacity", strconv.Itoa(capacity))
+		infof("%s 将人数上限设置为 %d", req.User.NickName, capacity)
+	}
+	max := "不限制"
+	if capacity > 0 {
+		max = strconv.Itoa(capacity)
+	}
+	prefix := "当前"
+	if req.Set {
+		prefix = "已设置"
+	}
+	req.User.tell(prefix + "人数上限：" + max + "，在线 " + strconv.Itoa(len(users)) + " 人")
+	return capacity
+}
+
+// roomFull 判断聊天室是否已满
+func roomFull(users map[*User]struct{}, capacity int) bool {
+	return capacity > 0 && len(users) >= capacity
+}
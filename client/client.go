@@ -2,33 +2,139 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/c-bata/go-prompt"
+	"github.com/mattn/go-runewidth"
 )
 
+// 输入提示符，重绘输入行时使用与 go-prompt 相同的颜色
+const (
+	promptPrefix      = ">>> "
+	promptPrefixColor = "\x1b[33m" + promptPrefix + "\x1b[0m"
+)
+
+// terminal 协调对终端的输出：go-prompt 渲染输入行和打印收到的消息共用一把锁，
+// 避免消息写到一半时输入行被重绘（或者反过来），导致输出错乱
+type terminal struct {
+	prompt.ConsoleWriter
+
+	mu sync.Mutex
+	// 输入行当前的内容，按光标位置分成两段，打印消息后据此重绘输入行
+	before, after string
+}
+
+// Flush go-prompt 每次渲染时先写入内部缓冲，最后通过 Flush 一次性输出，只需要在这里加锁
+func (t *terminal) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ConsoleWriter.Flush()
+}
+
+// update 记录输入行的内容，在 go-prompt 每次渲染前调用的补全回调中更新
+func (t *terminal) update(d prompt.Document) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.before, t.after = d.TextBeforeCursor(), d.TextAfterCursor()
+}
+
+// println 清掉当前的输入行，打印一行消息，再重绘输入行并把光标放回原来的位置
+func (t *terminal) println(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("\r\x1b[K" + line + "\n" + promptPrefixColor + t.before + t.after)
+	if w := runewidth.StringWidth(t.after); w > 0 {
+		fmt.Fprintf(&b, "\x1b[%dD", w)
+	}
+	os.Stdout.WriteString(b.String())
+}
+
+// logOutput 让 log 的输出也经过 println，不会打断输入行
+type logOutput struct{ t *terminal }
+
+func (w logOutput) Write(p []byte) (int, error) {
+	w.t.println(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// 连接服务端的超时时间，自检模式下也作为每一步的超时时间
+const dialTimeout = 5 * time.Second
+
 func main() {
-	conn, err := net.Dial("tcp", "127.0.0.1:2020")
+	server := flag.String("server", "127.0.0.1:2020", "服务端地址 host:port")
+	test := flag.Bool("test", false, "自检模式：连接服务端、进入聊天室并发送一条探测消息，测量往返延迟后退出，失败时返回非 0")
+	flag.Parse()
+
+	conn, err := dial(*server)
 	if err != nil {
+		if *test {
+			fmt.Println("FAIL: 连接失败：", err)
+			os.Exit(1)
+		}
 		log.Fatalf("Failed to connect to server: %v", err)
 	}
 	defer conn.Close()
+
+	if *test {
+		if err := selfTest(conn); err != nil {
+			fmt.Println("FAIL:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	term := &terminal{ConsoleWriter: prompt.NewStdoutWriter()}
+	log.SetOutput(logOutput{term})
 	log.Println("请在最前面添加 'gemini:' 来询问 Google AI gemini")
 
+	aliases, err := loadAliases()
+	if err != nil {
+		log.Printf("读取别名失败：%v", err)
+	}
+
 	done := make(chan struct{})
 
 	// 接收消息
 	go func() {
-		scanner := bufio.NewScanner(conn)
-		for scanner.Scan() {
-			fmt.Printf("\r%s\n>>> ", scanner.Text())
-		}
-		if scanner.Err() != nil {
-			log.Fatalf("Failed to read from server: %v", scanner.Err())
+		var lastSeq int64
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := readLine(reader, maxLineSize)
+			if errors.Is(err, errLineTooLong) {
+				// 超长的消息（如大段粘贴或 AI 回复）只跳过这一条，不影响后续接收
+				log.Printf("收到一条超过 %d 字节的消息，已跳过", maxLineSize)
+				continue
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatalf("Failed to read from server: %v", err)
+			}
+
+			// 服务端开启 SEQ_PREFIX 时，广播消息以 "#序号 " 开头，序号不连续说明漏收了消息
+			if seq, ok := parseSeq(line); ok {
+				if lastSeq > 0 && seq != lastSeq+1 {
+					log.Printf("漏收了 %d 条消息（#%d 到 #%d）", seq-lastSeq-1, lastSeq+1, seq-1)
+				}
+				lastSeq = seq
+			}
+			term.println(line)
 		}
 		done <- struct{}{}
 	}()
@@ -37,9 +143,11 @@ func main() {
 	go func() {
 		p := prompt.New(
 			func(in string) {
+				// 回车后输入行已清空
+				term.update(prompt.Document{})
 				in = strings.TrimSpace(in)
 				if in == "quit" || in == "exit" {
-					fmt.Println("退出聊天室...")
+					term.println("退出聊天室...")
 					conn.Close()
 					os.Exit(0)
 					return
@@ -47,20 +155,246 @@ func main() {
 				if in == "" {
 					return
 				}
+				// /alias、/unalias 只在本地处理，不发给服务端
+				if reply, ok := aliases.command(in); ok {
+					term.println(reply)
+					return
+				}
+				in = aliases.expand(in)
 				_, err := conn.Write([]byte(in + "\n"))
 				if err != nil {
 					log.Fatalf("Failed to write to server: %v", err)
 				}
 			},
 			func(d prompt.Document) []prompt.Suggest {
+				term.update(d)
 				// TODO 根据情况添加自动完成的建议
 				return []prompt.Suggest{}
 			},
-			prompt.OptionPrefix(">>> "),
+			prompt.OptionPrefix(promptPrefix),
 			prompt.OptionPrefixTextColor(prompt.Yellow),
+			prompt.OptionWriter(term),
 		)
 		p.Run()
 	}()
 
 	<-done
 }
+
+// aliasMap 个人命令别名，如 g -> gemini:，输入以别名开头时发送前替换，只在输入的 goroutine 中使用
+type aliasMap map[string]string
+
+// aliasPath 别名文件的位置：用户配置目录下的 tcpchatroom/aliases，每行一条 "别名=展开后的内容"
+func aliasPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tcpchatroom", "aliases"), nil
+}
+
+// loadAliases 读取别名文件，文件不存在时返回空的别名表
+func loadAliases() (aliasMap, error) {
+	aliases := make(aliasMap)
+	path, err := aliasPath()
+	if err != nil {
+		return aliases, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return aliases, nil
+	}
+	if err != nil {
+		return aliases, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if name, value, ok := strings.Cut(line, "="); ok && name != "" {
+			aliases[name] = value
+		}
+	}
+	return aliases, nil
+}
+
+// save 把别名按名称排序后写回文件
+func (a aliasMap) save() error {
+	path, err := aliasPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, name := range a.names() {
+		b.WriteString(name + "=" + a[name] + "\n")
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+func (a aliasMap) names() []string {
+	names := make([]string, 0, len(a))
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// expand 输入的第一个词为别名时替换成展开后的内容，只替换一次，不会递归展开
+func (a aliasMap) expand(in string) string {
+	name, rest, _ := strings.Cut(in, " ")
+	value, ok := a[name]
+	if !ok {
+		return in
+	}
+	if rest == "" {
+		return value
+	}
+	return value + " " + rest
+}
+
+// command 处理 /alias 和 /unalias，返回要显示的内容；不是这两个命令时返回 false
+//
+//	/alias              列出所有别名
+//	/alias g gemini:    添加或修改别名
+//	/unalias g          删除别名
+func (a aliasMap) command(in string) (string, bool) {
+	cmd, args, _ := strings.Cut(in, " ")
+	args = strings.TrimSpace(args)
+	switch cmd {
+	case "/alias":
+		if args == "" {
+			if len(a) == 0 {
+				return "还没有设置别名，用法：/alias <别名> <内容>", true
+			}
+			var b strings.Builder
+			b.WriteString("别名：")
+			for _, name := range a.names() {
+				b.WriteString("\n" + name + " -> " + a[name])
+			}
+			return b.String(), true
+		}
+		name, value, _ := strings.Cut(args, " ")
+		value = strings.TrimSpace(value)
+		if value == "" || strings.ContainsAny(name, "=") || name == "/alias" || name == "/unalias" {
+			return "用法：/alias <别名> <内容>，别名不能包含 =", true
+		}
+		a[name] = value
+		if err := a.save(); err != nil {
+			return "别名已设置，但保存失败：" + err.Error(), true
+		}
+		return "已设置别名：" + name + " -> " + value, true
+	case "/unalias":
+		if _, ok := a[args]; !ok {
+			return "没有别名 " + args, true
+		}
+		delete(a, args)
+		if err := a.save(); err != nil {
+			return "别名已删除，但保存失败：" + err.Error(), true
+		}
+		return "已删除别名 " + args, true
+	}
+	return "", false
+}
+
+// dial 连接服务端，交互模式和自检模式共用
+func dial(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, dialTimeout)
+}
+
+// selfTest 自检：等待昵称提示，用随机昵称进入聊天室，发送一条探测消息并等它广播回来，打印各步骤耗时
+func selfTest(conn net.Conn) error {
+	start := time.Now()
+	reader := bufio.NewReader(conn)
+	// waitFor 读取服务端的输出，直到某一行包含 want
+	waitFor := func(want string) error {
+		conn.SetReadDeadline(time.Now().Add(dialTimeout))
+		for {
+			line, err := readLine(reader, maxLineSize)
+			if errors.Is(err, errLineTooLong) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("等待 %q 时出错：%w", want, err)
+			}
+			if strings.Contains(line, want) {
+				return nil
+			}
+		}
+	}
+	send := func(line string) error {
+		conn.SetWriteDeadline(time.Now().Add(dialTimeout))
+		_, err := conn.Write([]byte(line + "\n"))
+		return err
+	}
+
+	if err := waitFor("昵称"); err != nil {
+		return err
+	}
+	nonce := strconv.FormatInt(time.Now().UnixNano(), 36)
+	nick := "selftest-" + nonce[len(nonce)-6:]
+	if err := send(nick); err != nil {
+		return err
+	}
+	if err := waitFor(nick); err != nil {
+		return fmt.Errorf("进入聊天室失败：%w", err)
+	}
+	joined := time.Now()
+
+	probe := "selftest probe " + nonce
+	if err := send(probe); err != nil {
+		return err
+	}
+	if err := waitFor(probe); err != nil {
+		return fmt.Errorf("没有收到探测消息：%w", err)
+	}
+	rtt := time.Since(joined)
+
+	fmt.Printf("PASS %s 进入聊天室 %v，消息往返 %v\n", conn.RemoteAddr(), joined.Sub(start).Round(time.Microsecond), rtt.Round(time.Microsecond))
+	return nil
+}
+
+// 单条消息的最大长度，超过时跳过该消息
+const maxLineSize = 1 << 20
+
+var errLineTooLong = errors.New("消息过长")
+
+// readLine 读取一行并去掉行尾的 \r\n，超过 max 字节时丢弃这一行剩余的内容并返回 errLineTooLong，
+// 之后可以继续读取下一行；连接关闭时最后一段没有换行的数据也作为一行返回
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > max+2 {
+				tooLong, line = true, nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || len(line) == 0 && !tooLong) {
+			return "", err
+		}
+		if tooLong {
+			return "", errLineTooLong
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// parseSeq 解析消息开头的 "#序号 "
+func parseSeq(line string) (int64, bool) {
+	if !strings.HasPrefix(line, "#") {
+		return 0, false
+	}
+	num, _, found := strings.Cut(line[1:], " ")
+	if !found {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(num, 10, 64)
+	return seq, err == nil
+}
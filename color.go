@@ -0,0 +1,30 @@
+package main
+
+import (
+	"hash/fnv"
+	"regexp"
+)
+
+const (
+	ansiReset = "\x1b[0m"
+	ansiGray  = "\x1b[90m"
+)
+
+// 昵称可用的颜色，按昵称哈希选取，同一昵称总是同一种颜色
+var nickColors = []string{
+	"\x1b[31m", "\x1b[32m", "\x1b[33m", "\x1b[34m", "\x1b[35m", "\x1b[36m",
+}
+
+// ansiPattern 匹配 ANSI 控制序列（CSI 序列和 OSC 序列）
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)`)
+
+// stripANSI 去掉字符串中的 ANSI 控制序列
+func stripANSI(s string) string {
+	return ansiPattern.ReplaceAllString(s, "")
+}
+
+func colorNick(nick string) string {
+	h := fnv.New32a()
+	h.Write([]byte(nick))
+	return nickColors[h.Sum32()%uint32(len(nickColors))] + nick + ansiReset
+}
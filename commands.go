@@ -0,0 +1,377 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 一行输入的类型
+const (
+	// 普通聊天消息
+	inputMessage = iota
+	// 以 gemini: 开头，询问 Gemini
+	inputGemini
+	// 以 / 开头的命令
+	inputCommand
+)
+
+// parsedInput 解析后的一行输入
+type parsedInput struct {
+	Kind int
+	// 命令名和参数，只对命令有效
+	Name string
+	Args string
+}
+
+// parseInput 对一行输入进行分类，任意输入都会被归为上面三类之一
+func parseInput(line string) parsedInput {
+	switch {
+	case strings.HasPrefix(line, "gemini:"):
+		return parsedInput{Kind: inputGemini}
+	case strings.HasPrefix(line, "/"):
+		name, args, _ := strings.Cut(line[1:], " ")
+		return parsedInput{Kind: inputCommand, Name: name, Args: strings.TrimSpace(args)}
+	default:
+		return parsedInput{Kind: inputMessage}
+	}
+}
+
+// handleInput 处理用户输入的一行内容
+func handleInput(user *User, line string) {
+	user.LastActiveAt.Store(time.Now().UnixNano())
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if isGarbage(line) {
+		user.notify("消息包含无法识别的内容，已丢弃")
+		return
+	}
+
+	if user.JSONMode.Load() && strings.HasPrefix(line, "{") {
+		handleEvent(user, line)
+		return
+	}
+
+	in := parseInput(line)
+	switch in.Kind {
+	case inputGemini:
+		user.notify(askGemini(user.ctx, line))
+	case inputCommand:
+		handleCommand(user, in.Name, in.Args)
+	default:
+		if msg := chatMessage(user, line); msg != nil {
+			submit(user.srv, user.srv.messageChannel, msg)
+		}
+	}
+}
+
+// chatMessage 把用户输入的内容转换成聊天消息，慢速模式下发送过快或者与上一条重复时返回 nil
+// 所有由用户发起的广播（普通消息、JSON chat 和 edit 事件、/quote、/shrug、/translate -all）都要经过这里
+func chatMessage(user *User, line string) *Message {
+	if wait := slowModeWait(user); wait > 0 {
+		user.notify("慢速模式：请等待 " + strconv.Itoa(int(math.Ceil(wait.Seconds()))) + "s")
+		return nil
+	}
+	// 先展开表情短码，再做长度限制、去重等后续处理
+	msg, truncated := truncateDisplay(expandEmoji(line), maxMessageWidth)
+	if truncated {
+		user.notify("消息过长，已截断")
+	}
+	if isDuplicate(user, msg) {
+		return nil
+	}
+	return newUserMessage(user, msg)
+}
+
+// handleCommand 处理以 / 开头的命令，结果直接回复给当前用户或进行广播
+func handleCommand(user *User, name, args string) {
+	// 参数可能包含密码，不记录
+	debugf("%s 执行命令 /%s", user.NickName, name)
+	switch name {
+	case "help":
+		user.notify(helpText)
+	case "welcome":
+		if time.Since(user.LastWelcomeAt) < welcomeCooldown {
+			user.notify("操作太频繁，请稍后再试")
+			return
+		}
+		user.LastWelcomeAt = time.Now()
+		submit(user.srv, user.srv.welcomeChannel, user)
+	case "token":
+		if user.ResumeToken == "" {
+			user.notify("服务端未开启断线重连")
+			return
+		}
+		user.TokenShown.Store(true)
+		user.notify("重连令牌：" + user.ResumeToken + "，断线后 " + resumeTTL.String() + " 内在昵称提示处发送 /resume <令牌> 即可找回昵称")
+	case "quote":
+		quoteCommand(user, args)
+	case "shrug":
+		// 不受 EMOJI_EXPAND 开关影响，和普通消息一样广播
+		if msg := chatMessage(user, strings.TrimSpace(args+" "+`¯\_(ツ)_/¯`)); msg != nil {
+			submit(user.srv, user.srv.messageChannel, msg)
+		}
+	case "msg":
+		to, text, _ := strings.Cut(args, " ")
+		text = strings.TrimSpace(text)
+		if to == "" || text == "" {
+			user.notify("用法：/msg <昵称> <内容>")
+			return
+		}
+		text, _ = truncateDisplay(expandEmoji(text), maxMessageWidth)
+		submit(user.srv, user.srv.privateChannel, privateMessage{From: user, To: to, Content: text})
+	case "away", "afk":
+		note := args
+		if note == "" {
+			note = "暂时离开"
+		}
+		note, _ = truncateDisplay(note, maxMessageWidth)
+		submit(user.srv, user.srv.awayChannel, awayRequest{User: user, Away: true, Note: note})
+	case "back":
+		backCommand(user)
+	case "admin":
+		adminCommand(user, args)
+	case "report":
+		target, reason, _ := strings.Cut(args, " ")
+		reason = strings.TrimSpace(reason)
+		if target == "" || reason == "" {
+			user.notify("用法：/report <昵称> <原因>")
+			return
+		}
+		reason, _ = truncateDisplay(reason, maxMessageWidth)
+		audit(user.Addr, "report", user.NickName+" -> "+target+"："+reason)
+		submit(user.srv, user.srv.reportChannel, &report{From: user, Target: target, Reason: reason, Time: time.Now()})
+	case "maintenance":
+		if !requireAdmin(user) {
+			return
+		}
+		switch args {
+		case "on", "off":
+			audit(user.Addr, "maintenance", user.NickName+" "+args)
+			submit(user.srv, user.srv.maintenanceChannel, args == "on")
+		default:
+			user.notify("用法：/maintenance on|off")
+		}
+	case "slowmode":
+		if !requireAdmin(user) {
+			return
+		}
+		var interval time.Duration
+		if args != "off" {
+			seconds, err := strconv.Atoi(args)
+			if err != nil || seconds < 0 {
+				user.notify("用法：/slowmode <秒数>|off")
+				return
+			}
+			interval = time.Duration(seconds) * time.Second
+		}
+		audit(user.Addr, "slowmode", user.NickName+" "+args)
+		submit(user.srv, user.srv.slowModeChannel, interval)
+	case "debug":
+		debugCommand(user)
+	case "clearhistory":
+		if !requireAdmin(user) {
+			return
+		}
+		audit(user.Addr, "clearhistory", user.NickName)
+		submit(user.srv, user.srv.clearHistoryChannel, user)
+	case "whois":
+		if args == "" {
+			user.notify("用法：/whois <昵称>")
+			return
+		}
+		submit(user.srv, user.srv.whoisChannel, whoisRequest{From: user, Nick: args})
+	case "json":
+		switch args {
+		case "on":
+			user.JSONMode.Store(true)
+			user.notify("已切换为 JSON 模式")
+		case "off":
+			user.JSONMode.Store(false)
+			user.notify("已切换为文本模式")
+		default:
+			user.notify("用法：/json on|off")
+		}
+	case "plain":
+		switch args {
+		case "", "on":
+			user.Plain.Store(true)
+			user.notify("已切换为纯文本模式，不再发送 ANSI 颜色")
+		case "off":
+			user.Plain.Store(false)
+			user.notify("已切换为彩色模式")
+		default:
+			user.notify("用法：/plain [on|off]")
+			return
+		}
+		savePrefs(user)
+	case "quiet":
+		// 只有读 goroutine 写入，Load 之后再 Store 不会和其他写入冲突
+		quiet := !user.Quiet.Load()
+		user.Quiet.Store(quiet)
+		if quiet {
+			user.notify("已屏蔽进入、离开提醒，再次输入 /quiet 恢复")
+		} else {
+			user.notify("已恢复进入、离开提醒")
+		}
+		savePrefs(user)
+	case "framing":
+		switch args {
+		case "nul":
+			user.Delimiter.Store(int32(delimNUL))
+			user.notify("已切换为 NUL 分隔，之后的每条消息都以 \\0 结尾")
+		case "newline":
+			user.Delimiter.Store(int32(delimNewline))
+			user.notify("已切换为按行分隔")
+		default:
+			user.notify("用法：/framing nul|newline")
+		}
+	case "translate":
+		translateCommand(user, args)
+	case "transcript":
+		transcriptCommand(user, args)
+	case "log":
+		logCommand(user, args)
+	case "roomstats":
+		submit(user.srv, user.srv.roomStatsChannel, user)
+	case "loglevel":
+		logLevelCommand(user, args)
+	case "capacity":
+		capacityCommand(user, args)
+	case "pin":
+		pinCommand(user, args)
+	case "unpin":
+		if requireAdmin(user) {
+			submit(user.srv, user.srv.pinChannel, pinRequest{User: user, Unpin: true})
+		}
+	case "migrate":
+		migrateCommand(user, args)
+	case "setmotd", "motd-set":
+		setMOTDCommand(user, args)
+	case "poll":
+		question, options, ok := parsePoll(args)
+		if !ok {
+			user.notify(`用法：/poll "问题" 选项1 选项2 ...（2 到 ` + strconv.Itoa(maxPollOptions) + ` 个选项）`)
+			return
+		}
+		submit(user.srv, user.srv.pollChannel, pollRequest{User: user, Action: pollOpen, Question: question, Options: options})
+	case "vote":
+		choice, err := strconv.Atoi(args)
+		if err != nil {
+			user.notify("用法：/vote <n>")
+			return
+		}
+		submit(user.srv, user.srv.pollChannel, pollRequest{User: user, Action: pollVote, Choice: choice})
+	case "poll-results":
+		submit(user.srv, user.srv.pollChannel, pollRequest{User: user, Action: pollResults})
+	case "poll-close":
+		submit(user.srv, user.srv.pollChannel, pollRequest{User: user, Action: pollClose})
+	default:
+		user.notify("未知命令：/" + name)
+	}
+}
+
+// quoteCommand 引用最近的第 n 条聊天消息（1 表示最新一条），可附带自己的回复
+// 用法：/quote <n> [回复内容]
+func quoteCommand(user *User, args string) {
+	index, reply, _ := strings.Cut(args, " ")
+	n, err := strconv.Atoi(index)
+	if err != nil {
+		user.notify("用法：/quote <n> [回复内容]")
+		return
+	}
+
+	history := user.srv.recentHistory()
+	if n < 1 || n > len(history) {
+		user.notify("没有第 " + index + " 条消息，当前共有 " + strconv.Itoa(len(history)) + " 条")
+		return
+	}
+
+	quoted := history[len(history)-n]
+	reply = strings.TrimSpace(reply)
+	if reply == "" {
+		// 只引用不回复
+		if msg := chatMessage(user, "> "+quoted.From+": "+quoted.Content); msg != nil {
+			submit(user.srv, user.srv.messageChannel, msg)
+		}
+		return
+	}
+	if msg := chatMessage(user, reply); msg != nil {
+		msg.Quote = quoted.From + ": " + quoted.Content
+		submit(user.srv, user.srv.messageChannel, msg)
+	}
+}
+
+// translateCommand 使用 Gemini 翻译文本，默认只回复给自己，加 -all 时广播译文
+// 用法：/translate [-all] <目标语言> <文本>
+func translateCommand(user *User, args string) {
+	all := false
+	if rest, ok := strings.CutPrefix(args, "-all "); ok {
+		all, args = true, strings.TrimSpace(rest)
+	}
+
+	lang, text, _ := strings.Cut(args, " ")
+	text = strings.TrimSpace(text)
+	if lang == "" || text == "" {
+		user.notify("用法：/translate [-all] <目标语言> <文本>")
+		return
+	}
+
+	if all {
+		// 和普通消息一样受慢速模式和去重限制，按原文检查，被拦下的请求不调用 Gemini
+		msg := chatMessage(user, text)
+		if msg == nil {
+			return
+		}
+		rep := askGemini(user.ctx, translatePrompt(lang, msg.Content))
+		msg.Content, _ = truncateDisplay(msg.Content+"\n（"+lang+"）"+rep, maxMessageWidth)
+		submit(user.srv, user.srv.messageChannel, msg)
+		return
+	}
+	text, _ = truncateDisplay(text, maxMessageWidth)
+	user.notify(askGemini(user.ctx, translatePrompt(lang, text)))
+}
+
+// transcriptCommand 把最近 n 条聊天记录整理成带时间和发送者的文本发给自己，n 默认为全部
+// 用法：/transcript [n]
+func transcriptCommand(user *User, args string) {
+	history := user.srv.recentHistory()
+	n := len(history)
+	if args != "" {
+		var err error
+		if n, err = strconv.Atoi(args); err != nil || n < 1 {
+			user.notify("用法：/transcript [n]")
+			return
+		}
+		n = min(n, len(history))
+	}
+	if n == 0 {
+		user.notify("暂无聊天记录")
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("聊天记录（最近 " + strconv.Itoa(n) + " 条）：")
+	for _, msg := range history[len(history)-n:] {
+		b.WriteString("\n[" + msg.Time.Format("2006-01-02 15:04:05") + "] " + msg.String())
+	}
+	user.notify(b.String())
+}
+
+// slowModeWait 返回慢速模式下用户还需等待多久才能发送下一条消息，不需要等待时返回 0 并记录本次发送时间
+// 管理员不受慢速模式限制
+func slowModeWait(user *User) time.Duration {
+	interval := time.Duration(user.srv.slowModeInterval.Load())
+	if interval <= 0 || user.IsAdmin.Load() {
+		return 0
+	}
+
+	now := time.Now()
+	if wait := user.LastSentAt.Add(interval).Sub(now); wait > 0 {
+		return wait
+	}
+	user.LastSentAt = now
+	return 0
+}
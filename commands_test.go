@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzParseCommand(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"hello",
+		" /help",
+		"gemini:你好",
+		"gemini:",
+		"/",
+		"/ ",
+		"/help",
+		"/msg bob 你好",
+		"/msg bob",
+		"/away 吃饭",
+		"/back",
+		"/quote 1 同意",
+		"/translate -all en 你好",
+		`/poll "去哪吃" 食堂 外卖`,
+		"/vote 2",
+		"/json on",
+		"/framing nul",
+		"/slowmode off",
+		"/admin  pw  ",
+		"/nick alice",
+		"/unknown\targ",
+		"//double",
+		"\x00\xff/help",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		in := parseInput(line)
+		switch in.Kind {
+		case inputGemini:
+			if !strings.HasPrefix(line, "gemini:") {
+				t.Errorf("%q 被识别为 Gemini 请求", line)
+			}
+		case inputCommand:
+			if !strings.HasPrefix(line, "/") {
+				t.Errorf("%q 被识别为命令", line)
+			}
+			if strings.Contains(in.Name, " ") {
+				t.Errorf("%q 的命令名 %q 包含空格", line, in.Name)
+			}
+			if !strings.HasPrefix(line[1:], in.Name) {
+				t.Errorf("%q 的命令名 %q 不是输入的前缀", line, in.Name)
+			}
+			if in.Args != strings.TrimSpace(in.Args) {
+				t.Errorf("%q 的参数 %q 没有去掉首尾空白", line, in.Args)
+			}
+		case inputMessage:
+			if strings.HasPrefix(line, "/") || strings.HasPrefix(line, "gemini:") {
+				t.Errorf("%q 被识别为普通消息", line)
+			}
+			if in.Name != "" || in.Args != "" {
+				t.Errorf("普通消息 %q 带有命令名或参数：%+v", line, in)
+			}
+		default:
+			t.Errorf("%q 的类型未知：%d", line, in.Kind)
+		}
+	})
+}
+
+func TestShrug(t *testing.T) {
+	setConfig(t, &emojiEnabled, false)
+	ts := startServer(t)
+	alice := ts.join("alice")
+	bob := ts.join("bob")
+	alice.expect("bob` has enter")
+
+	bob.send("/shrug")
+	if line := alice.expect("bob:"); line != `bob: ¯\_(ツ)_/¯` {
+		t.Errorf("收到 %q", line)
+	}
+	bob.send("/shrug 不知道")
+	if line := alice.expect("不知道"); line != `bob: 不知道 ¯\_(ツ)_/¯` {
+		t.Errorf("收到 %q", line)
+	}
+}
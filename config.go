@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+var (
+	geminiKey string
+
+	// 消息去重：同一用户在 dedupWindow 内连续发送完全相同的内容时只广播一次
+	dedupEnabled bool
+	dedupWindow  time.Duration
+
+	// 是否将 :shrug:、:smile: 等短码替换为表情
+	emojiEnabled bool
+
+	// 来源 IP 的白名单/黑名单
+	allowCIDRs []*net.IPNet
+	denyCIDRs  []*net.IPNet
+
+	// 内存中保留的最近聊天消息条数
+	historySize int
+
+	// 昵称和消息的最大显示宽度（全角字符和 emoji 计为 2），0 表示不限制
+	maxNickWidth    int
+	maxMessageWidth int
+	// 昵称不合法或重复时最多允许重新输入的次数，0 表示不限制
+	maxNickAttempts int
+
+	// TCP keep-alive 探测间隔，0 表示不开启
+	keepAlivePeriod time.Duration
+
+	// 同一 IP 同时在线的最大连接数，0 表示不限制
+	maxConnsPerIP int
+
+	// 启动时的人数上限，0 表示不限制，运行时可通过 /capacity 调整
+	maxUsers int
+
+	// 离开状态下最多暂存的私信条数
+	awayQueueSize int
+
+	// 审计日志文件路径，为空表示不记录
+	auditLogPath string
+
+	// WebSocket 网关监听地址，如 0.0.0.0:2021，为空表示不开启
+	wsListenAddr string
+
+	// 文本模式下是否在广播消息前加上 "#序号 "
+	seqPrefix bool
+	// 文本模式下默认是否使用 ANSI 颜色，客户端可通过 /plain 单独切换
+	colorEnabled bool
+
+	// 管理员密码，为空表示不开放管理员权限
+	adminPassword string
+	// 没有管理员在线时最多暂存的举报条数
+	reportQueueSize int
+
+	// 断线后为用户保留会话（昵称）的时长，期间可以使用重连令牌找回，0 表示不开启
+	resumeTTL time.Duration
+
+	// 发送后多长时间内允许编辑、删除（JSON 模式）
+	editWindow time.Duration
+
+	// MOTD 文件路径，进入聊天室时显示其内容，为空表示不显示
+	motdPath string
+
+	// 关键词自动回复机器人
+	botEnabled   bool
+	botName      string
+	botRulesPath string
+	botCooldown  time.Duration
+
+	// 超过多长时间没有输入时断开连接，0 表示不开启；idleKickExempt 为 true 时管理员和机器人不受限制
+	idleTimeout    time.Duration
+	idleKickExempt bool
+
+	// 同一 IP 在 reconnectWindow 内最多连接 reconnectLimit 次，超过后 reconnectCooldown 内拒绝新连接，0 表示不限制
+	reconnectLimit    int
+	reconnectWindow   time.Duration
+	reconnectCooldown time.Duration
+
+	// 监听 socket 的连接队列长度，0 表示使用系统默认值
+	listenBacklog int
+
+	// 单个连接在 lineRateWindow 内最多输入的行数，超过后断开连接，0 表示不限制
+	lineRateLimit  int
+	lineRateWindow time.Duration
+
+	// 只读镜像连接的令牌，为空表示不允许镜像连接
+	mirrorToken string
+
+	// 进入聊天室时的认证方式 none|password|file，以及共用密码和账号文件路径
+	authMode     string
+	authPassword string
+	authFilePath string
+
+	// /migrate 通知用户后等待多久再断开所有连接
+	migrateDelay time.Duration
+
+	// 个人设置文件路径，只保存 AUTH=file 认证过的用户的设置，为空表示不保存
+	prefsPath string
+
+	// 发送队列满时的处理方式，以及断开前允许连续丢弃的条数和时长，0 表示不按该项判断
+	slowClientPolicy   string
+	slowClientMaxDrops int
+	slowClientMaxStall time.Duration
+)
+
+// loadEnvFile 从本地 .env 文件读取环境变量
+// 没有 .env 文件时忽略；文件存在但格式错误时给出警告，设置 STRICT_ENV=true 时直接退出
+func loadEnvFile() {
+	err := godotenv.Load()
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if envBool("STRICT_ENV", false) {
+		log.Fatalln(".env 文件解析失败：", err)
+	}
+	log.Println("警告：.env 文件解析失败，将只使用系统环境变量：", err)
+}
+
+// logConfig 在启动时打印主要配置，便于确认配置是否生效，密钥等敏感信息脱敏显示
+func logConfig() {
+	log.Printf("配置：GEMINI_PRO_API_KEY=%s ADMIN_PASSWORD=%s HISTORY_SIZE=%d MAX_NICK_WIDTH=%d MAX_MESSAGE_WIDTH=%d MAX_CONNS_PER_IP=%d MAX_USERS=%d",
+		redact(geminiKey), redact(adminPassword), historySize, maxNickWidth, maxMessageWidth, maxConnsPerIP, maxUsers)
+	log.Printf("配置：MESSAGE_DEDUP=%v(%v) EMOJI_EXPAND=%v SEQ_PREFIX=%v COLOR=%v TCP_KEEPALIVE_PERIOD=%v",
+		dedupEnabled, dedupWindow, emojiEnabled, seqPrefix, colorEnabled, keepAlivePeriod)
+	log.Printf("配置：LOG_LEVEL=%s IDLE_TIMEOUT=%v IDLE_KICK_EXEMPT=%v MIGRATE_DELAY=%v",
+		levelNames[logLevel.Load()], idleTimeout, idleKickExempt, migrateDelay)
+	log.Printf("配置：RECONNECT_LIMIT=%d RECONNECT_WINDOW=%v RECONNECT_COOLDOWN=%v LINE_RATE_LIMIT=%d LINE_RATE_WINDOW=%v LISTEN_BACKLOG=%d",
+		reconnectLimit, reconnectWindow, reconnectCooldown, lineRateLimit, lineRateWindow, listenBacklog)
+	log.Printf("配置：AUTH=%s AUTH_PASSWORD=%s AUTH_FILE=%q PREFS_FILE=%q MIRROR_TOKEN=%s",
+		authMode, redact(authPassword), authFilePath, prefsPath, redact(mirrorToken))
+	log.Printf("配置：SLOW_CLIENT_POLICY=%s SLOW_CLIENT_MAX_DROPS=%d SLOW_CLIENT_MAX_STALL=%v",
+		slowClientPolicy, slowClientMaxDrops, slowClientMaxStall)
+	log.Printf("配置：ALLOW_CIDRS=%q DENY_CIDRS=%q AUDIT_LOG=%q WS_ADDR=%q BOT_ENABLED=%v",
+		cidrsString(allowCIDRs), cidrsString(denyCIDRs), auditLogPath, wsListenAddr, botEnabled)
+}
+
+// redact 隐藏敏感配置的值，只显示是否已设置
+func redact(v string) string {
+	if v == "" {
+		return "(未设置)"
+	}
+	return "(已设置)"
+}
+
+func cidrsString(nets []*net.IPNet) string {
+	items := make([]string, len(nets))
+	for i, n := range nets {
+		items[i] = n.String()
+	}
+	return strings.Join(items, ",")
+}
+
+// loadConfig 从环境变量读取配置，需在 godotenv.Load() 之后调用
+func loadConfig() {
+	geminiKey = os.Getenv("GEMINI_PRO_API_KEY")
+
+	dedupEnabled = envBool("MESSAGE_DEDUP", false)
+	dedupWindow = envDuration("MESSAGE_DEDUP_WINDOW", 2*time.Second)
+
+	emojiEnabled = envBool("EMOJI_EXPAND", true)
+
+	historySize = envInt("HISTORY_SIZE", 50)
+	if historySize < 0 {
+		historySize = 0
+	}
+
+	maxNickWidth = envInt("MAX_NICK_WIDTH", 20)
+	maxMessageWidth = envInt("MAX_MESSAGE_WIDTH", 1000)
+	maxNickAttempts = envInt("MAX_NICK_ATTEMPTS", 5)
+
+	keepAlivePeriod = envDuration("TCP_KEEPALIVE_PERIOD", 30*time.Second)
+
+	maxConnsPerIP = envInt("MAX_CONNS_PER_IP", 5)
+
+	maxUsers = envInt("MAX_USERS", 0)
+
+	awayQueueSize = envInt("AWAY_QUEUE_SIZE", 20)
+
+	auditLogPath = os.Getenv("AUDIT_LOG")
+
+	wsListenAddr = os.Getenv("WS_ADDR")
+
+	seqPrefix = envBool("SEQ_PREFIX", false)
+	colorEnabled = envBool("COLOR", true)
+
+	adminPassword = os.Getenv("ADMIN_PASSWORD")
+	reportQueueSize = envInt("REPORT_QUEUE_SIZE", 50)
+
+	resumeTTL = envDuration("RESUME_TTL", 2*time.Minute)
+	editWindow = envDuration("EDIT_WINDOW", 5*time.Minute)
+	motdPath = os.Getenv("MOTD_FILE")
+
+	botEnabled = envBool("BOT_ENABLED", false)
+	botName = envString("BOT_NAME", "bot")
+	botRulesPath = envString("BOT_KEYWORDS", "bot_keywords.txt")
+	botCooldown = envDuration("BOT_COOLDOWN", 10*time.Second)
+
+	level, ok := parseLogLevel(envString("LOG_LEVEL", "info"))
+	if !ok {
+		log.Printf("环境变量 LOG_LEVEL=%q 格式错误，使用默认值 info", os.Getenv("LOG_LEVEL"))
+		level = levelInfo
+	}
+	logLevel.Store(level)
+
+	idleTimeout = envDuration("IDLE_TIMEOUT", 0)
+	idleKickExempt = envBool("IDLE_KICK_EXEMPT", true)
+
+	reconnectLimit = envInt("RECONNECT_LIMIT", 20)
+	reconnectWindow = envDuration("RECONNECT_WINDOW", 10*time.Second)
+	reconnectCooldown = envDuration("RECONNECT_COOLDOWN", 30*time.Second)
+
+	listenBacklog = envInt("LISTEN_BACKLOG", 0)
+	lineRateLimit = envInt("LINE_RATE_LIMIT", 100)
+	lineRateWindow = envDuration("LINE_RATE_WINDOW", time.Second)
+
+	mirrorToken = os.Getenv("MIRROR_TOKEN")
+
+	authMode = envString("AUTH", "none")
+	authPassword = os.Getenv("AUTH_PASSWORD")
+	authFilePath = envString("AUTH_FILE", "accounts.txt")
+	prefsPath = os.Getenv("PREFS_FILE")
+	migrateDelay = envDuration("MIGRATE_DELAY", 5*time.Second)
+
+	slowClientPolicy = envString("SLOW_CLIENT_POLICY", slowPolicyDisconnect)
+	if slowClientPolicy != slowPolicyDisconnect && slowClientPolicy != slowPolicyDrop {
+		log.Printf("环境变量 SLOW_CLIENT_POLICY=%q 格式错误，使用默认值 %v", slowClientPolicy, slowPolicyDisconnect)
+		slowClientPolicy = slowPolicyDisconnect
+	}
+	slowClientMaxDrops = envInt("SLOW_CLIENT_MAX_DROPS", 50)
+	slowClientMaxStall = envDuration("SLOW_CLIENT_MAX_STALL", 10*time.Second)
+
+	var err error
+	if allowCIDRs, err = parseCIDRs(os.Getenv("ALLOW_CIDRS")); err != nil {
+		log.Fatalf("ALLOW_CIDRS 解析失败：%v", err)
+	}
+	if denyCIDRs, err = parseCIDRs(os.Getenv("DENY_CIDRS")); err != nil {
+		log.Fatalf("DENY_CIDRS 解析失败：%v", err)
+	}
+}
+
+// envString 读取字符串类型的环境变量，未设置时返回默认值
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envBool 读取布尔类型的环境变量，未设置或格式错误时返回默认值
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("环境变量 %s=%q 格式错误，使用默认值 %v", key, v, def)
+		return def
+	}
+	return b
+}
+
+// envInt 读取整数类型的环境变量，未设置或格式错误时返回默认值
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("环境变量 %s=%q 格式错误，使用默认值 %v", key, v, def)
+		return def
+	}
+	return n
+}
+
+// envDuration 读取时长类型的环境变量（如 2s、500ms），未设置或格式错误时返回默认值
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("环境变量 %s=%q 格式错误，使用默认值 %v", key, v, def)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// debugSnapshot 服务端状态快照，供管理员 /debug 排查问题
+type debugSnapshot struct {
+	Time        time.Time      `json:"time"`
+	Users       int            `json:"users"`
+	UserList    []debugUser    `json:"user_list"`
+	History     int            `json:"history"`
+	Maintenance bool           `json:"maintenance"`
+	SlowMode    string         `json:"slow_mode"`
+	ActivePoll  bool           `json:"active_poll"`
+	Reports     int            `json:"pending_reports"`
+	Limits      debugLimits    `json:"limits"`
+	Config      map[string]any `json:"config"`
+}
+
+// debugLimits 各项限流的当前状态
+type debugLimits struct {
+	// 每个 IP 当前的连接数（MAX_CONNS_PER_IP）
+	ConnsPerIP map[string]int `json:"conns_per_ip"`
+	// 因重连过于频繁仍在冷却中的 IP 及剩余时间（RECONNECT_*）
+	ReconnectCooldowns map[string]string `json:"reconnect_cooldowns"`
+	// 因接收过慢丢弃的消息总数和断开的连接数（SLOW_CLIENT_*），每个用户当前连续丢弃的条数见 user_list
+	SlowDrops int64 `json:"slow_client_drops"`
+	SlowKicks int64 `json:"slow_client_kicks"`
+	// 因输入速率过高断开的连接数（LINE_RATE_*）
+	LineRateKicks int64 `json:"line_rate_kicks"`
+}
+
+type debugUser struct {
+	ID      int    `json:"id"`
+	Nick    string `json:"nick"`
+	Addr    string `json:"addr"`
+	Online  string `json:"online"`
+	Idle    string `json:"idle"`
+	Away    bool   `json:"away"`
+	Admin   bool   `json:"admin"`
+	JSON    bool   `json:"json"`
+	Pending int    `json:"pending_messages"`
+	Drops   int    `json:"dropped_messages"`
+}
+
+// debugConfig 配置摘要，密钥只显示是否设置
+func debugConfig() map[string]any {
+	return map[string]any{
+		"GEMINI_PRO_API_KEY":    redact(geminiKey),
+		"ADMIN_PASSWORD":        redact(adminPassword),
+		"HISTORY_SIZE":          historySize,
+		"MAX_NICK_WIDTH":        maxNickWidth,
+		"MAX_MESSAGE_WIDTH":     maxMessageWidth,
+		"MAX_CONNS_PER_IP":      maxConnsPerIP,
+		"RECONNECT_LIMIT":       reconnectLimit,
+		"RECONNECT_WINDOW":      reconnectWindow.String(),
+		"RECONNECT_COOLDOWN":    reconnectCooldown.String(),
+		"LINE_RATE_LIMIT":       lineRateLimit,
+		"LINE_RATE_WINDOW":      lineRateWindow.String(),
+		"SLOW_CLIENT_POLICY":    slowClientPolicy,
+		"SLOW_CLIENT_MAX_DROPS": slowClientMaxDrops,
+		"SLOW_CLIENT_MAX_STALL": slowClientMaxStall.String(),
+		"MESSAGE_DEDUP":         dedupEnabled,
+		"EMOJI_EXPAND":          emojiEnabled,
+		"SEQ_PREFIX":            seqPrefix,
+		"COLOR":                 colorEnabled,
+		"BOT_ENABLED":           botEnabled,
+		"WS_ADDR":               wsListenAddr,
+		"AUDIT_LOG":             auditLogPath,
+	}
+}
+
+// snapshotUsers 在 broadcaster 中收集在线用户的状态，只拷贝字段，编码交给请求方完成，尽量少占用 broadcaster
+func snapshotUsers(users map[*User]struct{}) []debugUser {
+	now := time.Now()
+	list := make([]debugUser, 0, len(users))
+	for user := range users {
+		list = append(list, debugUser{
+			ID:      user.ID,
+			Nick:    user.NickName,
+			Addr:    user.Addr,
+			Online:  now.Sub(user.EnterAt).Round(time.Second).String(),
+			Idle:    now.Sub(user.lastActive()).Round(time.Second).String(),
+			Away:    user.Away,
+			Admin:   user.IsAdmin.Load(),
+			JSON:    user.JSONMode.Load(),
+			Pending: len(user.PendingMessages),
+			Drops:   user.drops,
+		})
+	}
+	return list
+}
+
+// debugCommand 管理员查看服务端状态快照
+func debugCommand(user *User) {
+	if !requireAdmin(user) {
+		return
+	}
+	audit(user.Addr, "debug", user.NickName)
+
+	reply := make(chan *debugSnapshot)
+	if !submit(user.srv, user.srv.debugChannel, reply) {
+		return
+	}
+	snapshot := <-reply
+	snapshot.Config = debugConfig()
+	snapshot.Limits.ConnsPerIP = snapshotConnsPerIP()
+	snapshot.Limits.ReconnectCooldowns = snapshotCooldowns(time.Now())
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		user.notify("生成快照失败：" + err.Error())
+		return
+	}
+	user.notify(string(data))
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestDebugShowsLimits(t *testing.T) {
+	setConfig(t, &adminPassword, "pw")
+	ts := startServer(t)
+	alice := ts.connect("10.0.0.1:1234")
+	alice.expect("请输入你的昵称")
+	alice.send("alice")
+	alice.expect("欢迎你的到来")
+	alice.send("/admin pw")
+	alice.expect("已获得管理员权限")
+
+	alice.send("/debug")
+	alice.expect(`"limits"`)
+	alice.expect(`"10.0.0.1": 1`)
+	alice.expect(`"line_rate_kicks": 0`)
+	alice.expect(`"LINE_RATE_LIMIT"`)
+}
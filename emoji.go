@@ -0,0 +1,42 @@
+package main
+
+import "strings"
+
+// emojiShortcodes 文本短码到表情的映射，广播前进行替换
+var emojiShortcodes = map[string]string{
+	":shrug:":    `¯\_(ツ)_/¯`,
+	":smile:":    "😄",
+	":laugh:":    "😂",
+	":wink:":     "😉",
+	":cry:":      "😢",
+	":angry:":    "😠",
+	":heart:":    "❤️",
+	":thumbsup:": "👍",
+	":+1:":       "👍",
+	":-1:":       "👎",
+	":ok:":       "👌",
+	":wave:":     "👋",
+	":clap:":     "👏",
+	":fire:":     "🔥",
+	":tada:":     "🎉",
+	":thinking:": "🤔",
+	":eyes:":     "👀",
+}
+
+var emojiReplacer = newEmojiReplacer()
+
+func newEmojiReplacer() *strings.Replacer {
+	pairs := make([]string, 0, len(emojiShortcodes)*2)
+	for code, emoji := range emojiShortcodes {
+		pairs = append(pairs, code, emoji)
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// expandEmoji 将消息中的短码替换为对应表情，未开启时原样返回
+func expandEmoji(msg string) string {
+	if !emojiEnabled {
+		return msg
+	}
+	return emojiReplacer.Replace(msg)
+}
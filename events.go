@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// clientEvent JSON 模式下客户端发送的结构化事件，每行一个 JSON 对象：
+//
+//	{"type":"chat","text":"消息内容","reply_to":12}
+//	{"type":"edit","seq":12,"text":"修改后的内容"}
+//	{"type":"delete","seq":12}
+//	{"type":"react","seq":12,"emoji":"👍"}
+//	{"type":"unreact","seq":12,"emoji":"👍"}
+//	{"type":"roster"}
+//
+// seq、reply_to 为消息的广播序号，编辑、删除只能针对自己发送的消息，回复和回应可以针对聊天记录中的任意消息
+type clientEvent struct {
+	Type    string `json:"type"`
+	Seq     int64  `json:"seq"`
+	Text    string `json:"text"`
+	Emoji   string `json:"emoji"`
+	ReplyTo int64  `json:"reply_to"`
+}
+
+// editRequest 编辑或删除已发送的消息，由 broadcaster 校验后广播
+type editRequest struct {
+	User   *User
+	Seq    int64
+	Text   string
+	Delete bool
+}
+
+// handleEvent 处理 JSON 模式下的结构化事件
+func handleEvent(user *User, line string) {
+	var ev clientEvent
+	if err := json.Unmarshal([]byte(line), &ev); err != nil {
+		user.notify("事件格式错误：" + err.Error())
+		return
+	}
+
+	switch ev.Type {
+	case "chat":
+		if strings.TrimSpace(ev.Text) == "" {
+			user.notify("消息内容不能为空")
+			return
+		}
+		if msg := chatMessage(user, ev.Text); msg != nil {
+			msg.ReplyTo = ev.ReplyTo
+			submit(user.srv, user.srv.messageChannel, msg)
+		}
+	case "edit":
+		text := strings.TrimSpace(ev.Text)
+		if text == "" {
+			user.notify("编辑后的内容不能为空")
+			return
+		}
+		// 编辑同样会广播给所有人，和新消息一样经过慢速模式、截断和去重
+		if msg := chatMessage(user, text); msg != nil {
+			submit(user.srv, user.srv.editChannel, editRequest{User: user, Seq: ev.Seq, Text: msg.Content})
+		}
+	case "delete":
+		submit(user.srv, user.srv.editChannel, editRequest{User: user, Seq: ev.Seq, Delete: true})
+	case "roster":
+		submit(user.srv, user.srv.rosterChannel, user)
+	case "react", "unreact":
+		emoji := expandEmoji(strings.TrimSpace(ev.Emoji))
+		if emoji == "" || len(emoji) > maxEmojiLen || strings.ContainsAny(emoji, " \t") || hasControl(emoji) {
+			user.notify("表情格式错误")
+			return
+		}
+		submit(user.srv, user.srv.reactChannel, reactRequest{User: user, Seq: ev.Seq, Emoji: emoji, Remove: ev.Type == "unreact"})
+	default:
+		user.notify("未知事件：" + ev.Type)
+	}
+}
+
+// handleEdit 在 broadcaster 中编辑或删除历史消息，只允许修改自己在 editWindow 内发送、仍在聊天记录中的消息
+// 历史中的消息可能正被写 goroutine 读取，编辑时替换为新的拷贝而不是原地修改
+func (s *Server) handleEdit(users map[*User]struct{}, history []*Message, req editRequest) []*Message {
+	i := findHistory(history, req.Seq)
+	if i < 0 {
+		req.User.tell("找不到消息 #" + formatSeq(req.Seq) + "，可能已超出聊天记录范围")
+		return history
+	}
+	orig := history[i]
+	if orig.sender != req.User {
+		req.User.tell("只能修改自己发送的消息")
+		return history
+	}
+	if time.Since(orig.Time) > editWindow {
+		req.User.tell("只能修改 " + editWindow.String() + " 内发送的消息")
+		return history
+	}
+
+	event := newUserMessage(req.User, req.Text)
+	event.Ref = req.Seq
+	if req.Delete {
+		event.Kind = KindDelete
+		event.Content = ""
+		history = append(history[:i:i], history[i+1:]...)
+	} else {
+		event.Kind = KindEdit
+		event.Edited = true
+		edited := *orig
+		edited.Content = req.Text
+		edited.Edited = true
+		history[i] = &edited
+	}
+	s.broadcast(users, event)
+	return history
+}
+
+// resolveReply 在 broadcaster 中查找消息回复的原消息，记下原发送者用于文本模式的 "回复 @昵称：" 前缀
+// 原消息不存在或已超出聊天记录范围时去掉 reply_to，作为普通消息发送并提示发送者
+func resolveReply(users map[*User]struct{}, history []*Message, msg *Message) {
+	i := findHistory(history, msg.ReplyTo)
+	if i >= 0 {
+		msg.replyNick = history[i].From
+		return
+	}
+	if _, ok := users[msg.sender]; ok {
+		msg.sender.tell("找不到消息 #" + formatSeq(msg.ReplyTo) + "，可能已超出聊天记录范围，已作为普通消息发送")
+	}
+	msg.ReplyTo = 0
+}
+
+// findHistory 按序号查找聊天记录，找不到时返回 -1
+func findHistory(history []*Message, seq int64) int {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Seq == seq {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendChatEvent 以 JSON 事件发送一条消息，返回它的广播序号
+func sendChatEvent(t *testing.T, c *testClient, text string) int64 {
+	t.Helper()
+	c.send(`{"type":"chat","text":"` + text + `"}`)
+	var msg Message
+	if err := json.Unmarshal([]byte(c.expect(`"text":"`+text+`"`)), &msg); err != nil {
+		t.Fatalf("解析消息失败：%v", err)
+	}
+	return msg.Seq
+}
+
+// joinAdmin 以 nick 进入聊天室并获得管理员权限
+func joinAdmin(ts *testServer, nick string) *testClient {
+	ts.t.Helper()
+	c := ts.join(nick)
+	c.send("/admin pw")
+	c.expect("已获得管理员权限")
+	return c
+}
+
+func TestEditDuringMaintenance(t *testing.T) {
+	setConfig(t, &adminPassword, "pw")
+	ts := startServer(t)
+	alice := joinAdmin(ts, "alice")
+	bob := ts.join("bob")
+	bob.send("/json on")
+	bob.expect("已切换为 JSON 模式")
+	seq := sendChatEvent(t, bob, "hello")
+
+	alice.send("/maintenance on")
+	alice.expect("进入维护模式")
+	bob.send(`{"type":"edit","seq":` + strconv.FormatInt(seq, 10) + `,"text":"SPAM"}`)
+	bob.expect("服务器维护中，编辑未发送")
+	for _, line := range alice.collect(200 * time.Millisecond) {
+		if strings.Contains(line, "SPAM") {
+			t.Errorf("维护模式下广播了普通用户的编辑：%q", line)
+		}
+	}
+}
+
+func TestEditSlowMode(t *testing.T) {
+	setConfig(t, &adminPassword, "pw")
+	ts := startServer(t)
+	alice := joinAdmin(ts, "alice")
+	bob := ts.join("bob")
+	bob.send("/json on")
+	bob.expect("已切换为 JSON 模式")
+
+	alice.send("/slowmode 60")
+	alice.expect("慢速模式")
+	seq := sendChatEvent(t, bob, "hello")
+	for i := 0; i < 5; i++ {
+		bob.send(`{"type":"edit","seq":` + strconv.FormatInt(seq, 10) + `,"text":"edit ` + strconv.Itoa(i) + `"}`)
+		bob.expect("慢速模式：请等待")
+	}
+	for _, line := range alice.collect(200 * time.Millisecond) {
+		if strings.Contains(line, "已编辑") {
+			t.Errorf("慢速模式下广播了编辑：%q", line)
+		}
+	}
+}
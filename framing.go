@@ -0,0 +1,44 @@
+package main
+
+import "bytes"
+
+// 每条消息的分隔符
+const (
+	// 默认按行分隔，适合交互式客户端
+	delimNewline byte = '\n'
+	// 以 NUL 结尾，消息内容可以包含换行，适合机器人等程序接入
+	delimNUL byte = 0
+)
+
+// delimiter 返回当前连接使用的消息分隔符
+func (u *User) delimiter() byte {
+	return byte(u.Delimiter.Load())
+}
+
+// splitFunc 返回按用户当前分隔符切分输入的 bufio.SplitFunc
+// 每次切分时都会读取最新的分隔符，因此连接中途通过 /framing 切换后，后续输入立即按新的方式切分
+func (u *User) splitFunc() func(data []byte, atEOF bool) (int, []byte, error) {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+
+		delim := u.delimiter()
+		if i := bytes.IndexByte(data, delim); i >= 0 {
+			return i + 1, trimFrame(data[:i], delim), nil
+		}
+		// 连接关闭时，最后一段没有分隔符的数据也作为一条消息
+		if atEOF {
+			return len(data), trimFrame(data, delim), nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// trimFrame 按行分隔时和 bufio.ScanLines 一样去掉行尾的 \r
+func trimFrame(data []byte, delim byte) []byte {
+	if delim == delimNewline {
+		return bytes.TrimSuffix(data, []byte{'\r'})
+	}
+	return data
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// isGarbage 判断一行输入是否像二进制数据或乱码：不是合法的 UTF-8，或者控制字符占比超过四分之一
+// 制表符和换行（NUL 分隔时消息可以包含换行）不算控制字符，偶尔夹带的 ANSI 颜色序列也不会被误判
+func isGarbage(s string) bool {
+	if !utf8.ValidString(s) {
+		return true
+	}
+
+	total, control := 0, 0
+	for _, r := range s {
+		total++
+		if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+			control++
+		}
+	}
+	return control*4 > total
+}
+
+// hasControl 判断字符串中是否包含控制字符
+func hasControl(s string) bool {
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// randomBinary 生成一段不含换行、且不是合法 UTF-8 的随机数据，模拟端口扫描器或连错服务的客户端
+func randomBinary(r *rand.Rand, n int) []byte {
+	data := make([]byte, n)
+	r.Read(data)
+	data = bytes.ReplaceAll(data, []byte{'\n'}, []byte{0})
+	// 0xff 在 UTF-8 中不会出现，保证整行一定不合法
+	return append([]byte{0xff}, data...)
+}
+
+func TestIsGarbage(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		data := make([]byte, 1+r.Intn(256))
+		r.Read(data)
+		if !utf8.Valid(data) && !isGarbage(string(data)) {
+			t.Errorf("非法 UTF-8 没有被识别：%q", data)
+		}
+	}
+
+	for _, s := range []string{
+		"hello",
+		"你好，世界 😀",
+		"a\tb",
+		"多行\n消息",
+		"\x1b[31m红色\x1b[0m 的文字",
+	} {
+		if isGarbage(s) {
+			t.Errorf("%q 被误判为乱码", s)
+		}
+	}
+	for _, s := range []string{"\x00\x01\x02\x03", "ab\x00\x00\x00", "\xff\xfe"} {
+		if !isGarbage(s) {
+			t.Errorf("%q 没有被识别为乱码", s)
+		}
+	}
+}
+
+func TestBinaryInputRejected(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	ts := startServer(t)
+	alice := ts.join("alice")
+	bob := ts.join("bob")
+	alice.expect("bob` has enter")
+
+	// 在线用户发送的乱码被丢弃，不会广播
+	for i := 0; i < 20; i++ {
+		bob.conn.Write(append(randomBinary(r, 1+r.Intn(128)), '\n'))
+		bob.expect("无法识别的内容，已丢弃")
+	}
+	bob.send("ok")
+	alice.expect("bob: ok")
+
+	// 把乱码当作昵称发送的连接直接被断开，不会进入聊天室
+	for i := 0; i < 5; i++ {
+		c := ts.connect("")
+		c.expect("请输入你的昵称")
+		io.WriteString(c.conn, string(randomBinary(r, 64))+"\n")
+		c.expectClosed()
+	}
+	bob.send("done")
+	alice.expect("bob: done")
+
+	for _, line := range alice.received {
+		if (strings.Contains(line, "has enter") && !strings.Contains(line, "bob")) || strings.ContainsRune(line, utf8.RuneError) {
+			t.Errorf("聊天室收到了异常内容：%q", line)
+		}
+	}
+}
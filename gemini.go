@@ -3,18 +3,17 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 
 	"github.com/google/generative-ai-go/genai"
 	"google.golang.org/api/option"
 )
 
-func GeminiChatComplete(req string) string {
-	ctx := context.Background()
+// GeminiChatComplete 向 Gemini 发起一次请求，ctx 取消时请求随之中止
+func GeminiChatComplete(ctx context.Context, req string) (string, error) {
 	// Access your API key as an environment variable (see "Set up your API key" above)
 	client, err := genai.NewClient(ctx, option.WithAPIKey(geminiKey))
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 	defer client.Close()
 
@@ -22,10 +21,40 @@ func GeminiChatComplete(req string) string {
 	model := client.GenerativeModel("gemini-pro")
 	resp, err := model.GenerateContent(ctx, genai.Text(req))
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
-	return printResponse(resp)
+	return printResponse(resp), nil
+}
+
+// geminiComplete 实际发起 Gemini 请求的函数，测试中替换为不访问网络的实现
+var geminiComplete = GeminiChatComplete
+
+// askGemini 向 Gemini 发起请求并返回回复，gemini: 和 /translate 等都通过这里调用，
+// 请求失败时只记录日志并返回提示，不影响服务端运行
+// 每次请求都是独立的单轮对话，不保留任何上下文，因此不同用户之间不会互相影响；
+// 聊天室只有一个房间，也不存在跨房间的上下文需要隔离
+//
+// ctx 为发起请求的用户的连接生命周期：请求在读 goroutine 中同步进行，对端关闭连接、写失败、被踢或者服务关闭时
+// ctx 被取消，进行中的请求随即中止，不再浪费配额。读 goroutine 要等请求返回后才会走离开流程、关闭 MessageChannel，
+// 所以回复即使在断开之后才到达，也不会发往已关闭的 channel
+func askGemini(ctx context.Context, req string) string {
+	geminiCalls.Add(1)
+	rep, err := geminiComplete(ctx, req)
+	if ctx.Err() != nil {
+		debugf("用户已断开，取消 Gemini 请求")
+		return "Gemini 请求已取消"
+	}
+	if err != nil {
+		warnf("Gemini 请求失败：%v", err)
+		return "Gemini 请求失败，请稍后再试"
+	}
+	return rep
+}
+
+// translatePrompt 构造翻译用的提示词，目标语言原样交给 Gemini 理解
+func translatePrompt(lang, text string) string {
+	return fmt.Sprintf("Translate the following text into %s. Reply with the translation only.\n\n%s", lang, text)
 }
 
 // Print response
@@ -34,7 +63,7 @@ func printResponse(resp *genai.GenerateContentResponse) string {
 	for _, cand := range resp.Candidates {
 		for _, part := range cand.Content.Parts {
 			ret = ret + fmt.Sprintf("%v", part)
-			log.Println(part)
+			debugf("Gemini 回复：%v", part)
 		}
 	}
 	return ret
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGeminiReply(t *testing.T) {
+	setConfig(t, &geminiComplete, func(ctx context.Context, req string) (string, error) {
+		return "回复：" + req, nil
+	})
+	ts := startServer(t)
+	bob := ts.join("bob")
+
+	bob.send("gemini: 你好")
+	bob.expect("回复：gemini: 你好")
+}
+
+func TestGeminiCanceledOnDisconnect(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	// 模拟一个很慢的流式回复：不停地产出内容，直到请求被取消
+	setConfig(t, &geminiComplete, func(ctx context.Context, req string) (string, error) {
+		close(started)
+		var rep string
+		for {
+			select {
+			case <-ctx.Done():
+				close(canceled)
+				return rep, ctx.Err()
+			case <-time.After(10 * time.Millisecond):
+				rep += "……"
+			}
+		}
+	})
+	verifyNoLeak(t)
+	ts := startServer(t)
+	alice := ts.join("alice")
+	bob := ts.join("bob")
+	alice.expect("bob` has enter")
+
+	bob.send("gemini: 讲一个很长的故事")
+	waitFor(t, started, "Gemini 请求开始")
+	bob.close()
+	waitFor(t, canceled, "Gemini 请求被取消")
+	// 读 goroutine 等请求返回后才走离开流程，回复不会发往已关闭的 channel
+	alice.expect("bob` has left")
+}
+
+func TestTranslateAllChecksBeforeGemini(t *testing.T) {
+	var calls atomic.Int32
+	setConfig(t, &geminiComplete, func(ctx context.Context, req string) (string, error) {
+		calls.Add(1)
+		return "hello", nil
+	})
+	setConfig(t, &dedupEnabled, true)
+	setConfig(t, &adminPassword, "pw")
+	ts := startServer(t)
+	alice := joinAdmin(ts, "alice")
+	bob := ts.join("bob")
+
+	// 重复的内容被去重，不调用 Gemini
+	bob.send("/translate -all en 你好")
+	alice.expect("（en）hello")
+	bob.send("/translate -all en 你好")
+	bob.send("/translate -all en 再见")
+	alice.expect("bob: 再见")
+	if n := calls.Load(); n != 2 {
+		t.Errorf("去重的请求也调用了 Gemini，共 %d 次", n)
+	}
+
+	// 慢速模式下发送过快时直接拒绝，同样不调用 Gemini
+	alice.send("/slowmode 60")
+	bob.expect("慢速模式")
+	bob.send("/translate -all en 早上好")
+	alice.expect("bob: 早上好")
+	bob.send("/translate -all en 晚上好")
+	bob.expect("慢速模式：请等待")
+	if n := calls.Load(); n != 3 {
+		t.Errorf("慢速模式拦下的请求也调用了 Gemini，共 %d 次", n)
+	}
+}
+
+// waitFor 等待 ch 关闭，超时则测试失败
+func waitFor(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(testTimeout):
+		t.Fatalf("等待%s超时", what)
+	}
+}
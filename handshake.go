@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// 元数据的大小限制
+const (
+	maxMetadataKeys     = 16
+	maxMetadataKeyLen   = 32
+	maxMetadataValueLen = 256
+)
+
+// 当前的协议版本
+const protocolVersion = 1
+
+// 版本握手中可以协商的功能
+const (
+	// 之后的消息都以 JSON 发送
+	featureJSON = "json"
+	// 不输出 ANSI 控制序列
+	featurePlain = "plain"
+	// 消息以 NUL 分隔
+	featureNUL = "nul"
+	// 双向使用 deflate 压缩（RFC 1951），每条消息后 flush
+	featureDeflate = "deflate"
+	// 推送在线用户列表的增量，需要同时开启 json
+	featureRoster = "roster"
+)
+
+// handshake JSON 客户端在昵称提示后发送的第一行，用来代替纯文本昵称：
+//
+//	{"nick":"alice","metadata":{"client":"mybot/1.0","platform":"linux","capabilities":"reactions,edit"}}
+//
+// metadata 为可选的客户端信息，管理员可以通过 /whois 查看。
+// 断线重连时用 token 代替 nick，出示之前通过 /token 获取的令牌即可找回原来的昵称：
+//
+//	{"token":"9f86d081884c7d659a2feaa0c55ad015"}
+//
+// 纯文本客户端在昵称提示后发送 "/resume <令牌>" 实现同样的效果。
+// 归档用的日志机器人可以用 {"mirror":"<MIRROR_TOKEN>"} 或 "/mirror <MIRROR_TOKEN>" 以只读镜像接入。
+//
+// 带 version 的握手一次协商所有协议选项，features 为客户端希望开启的功能：
+//
+//	{"version":1,"nick":"alice","features":["json","nul","deflate"]}
+//
+// 服务端先回复一条 JSON 格式的 hello，列出实际开启的功能，之后的数据都按协商结果收发：
+//
+//	{"type":"hello","version":1,"features":["json","nul","deflate"],...}
+//
+// hello 本身已经使用协商后的分隔符，但不压缩；开启 deflate 时客户端需要等收到 hello 后再发送压缩数据。
+// 每个连接只协商一次、只回复一次 hello：昵称被拒绝后重新发送的握手沿用第一次的协商结果，其中的 features 被忽略。
+// 没有 version 的 JSON 握手按旧方式处理，总是切换到 JSON 模式；第一行不是 JSON 时按纯文本昵称处理
+type handshake struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+	Nick     string   `json:"nick"`
+	Token    string   `json:"token"`
+	// 服务端开启认证（AUTH）时的密码，为空时服务端会单独提示输入
+	Credential string `json:"credential"`
+	// 以只读镜像接入时的令牌（MIRROR_TOKEN），此时不需要昵称
+	Mirror   string            `json:"mirror"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// nickLine 昵称行的解析结果
+type nickLine struct {
+	Nick       string
+	Token      string
+	Credential string
+	Mirror     string
+	// 带 version 的握手中的协议版本和客户端希望开启的功能，由调用方交给 negotiate
+	Version  int
+	Features []string
+	// 握手格式错误的原因，为空表示成功
+	Reason string
+}
+
+// parseNickLine 解析昵称行：以 { 开头时按 JSON 握手处理，以 /resume 开头时为重连，否则整行作为昵称
+func parseNickLine(user *User, line string) nickLine {
+	line = strings.TrimSpace(line)
+	if rest, ok := strings.CutPrefix(line, "/resume "); ok {
+		return nickLine{Token: strings.TrimSpace(rest)}
+	}
+	if rest, ok := strings.CutPrefix(line, "/mirror "); ok {
+		return nickLine{Mirror: strings.TrimSpace(rest)}
+	}
+	if !strings.HasPrefix(line, "{") {
+		return nickLine{Nick: line}
+	}
+
+	var hs handshake
+	if err := json.Unmarshal([]byte(line), &hs); err != nil || hs.Version < 0 {
+		return nickLine{Reason: "握手格式错误"}
+	}
+	if reason := checkMetadata(hs.Metadata); reason != "" {
+		return nickLine{Reason: reason}
+	}
+	user.Metadata = hs.Metadata
+	result := nickLine{Nick: strings.TrimSpace(hs.Nick), Token: hs.Token, Credential: hs.Credential, Mirror: hs.Mirror,
+		Version: hs.Version, Features: hs.Features}
+	if hs.Version == 0 {
+		user.JSONMode.Store(true)
+	}
+	return result
+}
+
+// negotiate 按客户端请求的功能设置连接，并回复 hello 告知实际开启的功能
+// 不认识的功能直接忽略，返回是否开启了 deflate；canDeflate 为 false 时不会同意开启压缩，如 WebSocket 连接
+func negotiate(user *User, features []string, canDeflate bool) bool {
+	var jsonMode, plain, nul, deflate, roster bool
+	for _, f := range features {
+		switch f {
+		case featureJSON:
+			jsonMode = true
+		case featurePlain:
+			plain = true
+		case featureNUL:
+			nul = true
+		case featureDeflate:
+			deflate = canDeflate
+		case featureRoster:
+			roster = true
+		}
+	}
+	roster = roster && jsonMode
+
+	// 未请求的功能恢复为默认值，结果只取决于这次握手
+	user.JSONMode.Store(jsonMode)
+	user.Roster = roster
+	user.Plain.Store(plain || !colorEnabled)
+	if nul {
+		user.Delimiter.Store(int32(delimNUL))
+	} else {
+		user.Delimiter.Store(int32(delimNewline))
+	}
+
+	accepted := []string{}
+	for _, f := range []struct {
+		name string
+		on   bool
+	}{{featureJSON, jsonMode}, {featurePlain, plain}, {featureNUL, nul}, {featureDeflate, deflate}, {featureRoster, roster}} {
+		if f.on {
+			accepted = append(accepted, f.name)
+		}
+	}
+	hello := newNotice("")
+	hello.Kind = KindHello
+	hello.Version = protocolVersion
+	hello.Features = accepted
+	hello.startDeflate = deflate
+	user.MessageChannel <- hello
+	return deflate
+}
+
+func checkMetadata(metadata map[string]string) string {
+	if len(metadata) > maxMetadataKeys {
+		return "元数据最多包含 16 项"
+	}
+	for k, v := range metadata {
+		if len(k) > maxMetadataKeyLen || len(v) > maxMetadataValueLen {
+			return "元数据的键最长 32 字节，值最长 256 字节"
+		}
+		// 管理员通过 /whois 原样查看，不能夹带 ANSI 控制序列等内容
+		if hasControl(k) || hasControl(v) {
+			return "元数据不能包含控制字符"
+		}
+	}
+	return ""
+}
+
+// hasCapability 判断客户端是否在握手元数据的 capabilities 中声明了某项能力（逗号分隔）
+// 纯文本客户端没有元数据，总是返回 false
+func (u *User) hasCapability(name string) bool {
+	for _, c := range strings.Split(u.Metadata["capabilities"], ",") {
+		if strings.TrimSpace(c) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		ok       bool
+	}{
+		{"没有元数据", nil, true},
+		{"普通内容", map[string]string{"client": "mybot/1.0", "platform": "linux"}, true},
+		{"值过长", map[string]string{"client": strings.Repeat("a", maxMetadataValueLen+1)}, false},
+		{"键过长", map[string]string{strings.Repeat("k", maxMetadataKeyLen+1): "v"}, false},
+		{"值包含 ANSI 控制序列", map[string]string{"client": "\x1b[2J\x1b[31mroot"}, false},
+		{"值包含换行", map[string]string{"client": "bot\nadmin: yes"}, false},
+		{"键包含控制字符", map[string]string{"cli\x07ent": "bot"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reason := checkMetadata(tt.metadata); (reason == "") != tt.ok {
+				t.Errorf("checkMetadata(%q) = %q", tt.metadata, reason)
+			}
+		})
+	}
+}
+
+func TestHelloSentOnce(t *testing.T) {
+	ts := startServer(t)
+	ts.join("alice")
+
+	c := ts.connect("")
+	c.expect("请输入你的昵称")
+	c.send(`{"version":1,"nick":"alice","features":["json"]}`)
+	c.expect(`"type":"hello"`)
+	c.expect("已被使用")
+	// 昵称被拒绝后重新握手，沿用之前的协商结果，不再回复 hello
+	c.send(`{"version":1,"nick":"bob","features":["json","plain"]}`)
+	c.expect("欢迎你的到来")
+	hellos := 0
+	for _, line := range c.received {
+		if strings.Contains(line, `"type":"hello"`) {
+			hellos++
+		}
+	}
+	if hellos != 1 {
+		t.Errorf("收到 %d 条 hello，期望 1 条", hellos)
+	}
+}
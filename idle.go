@@ -0,0 +1,30 @@
+package main
+
+import "time"
+
+// idleTicker 返回检查空闲用户的定时器，未开启空闲断开时返回 nil，select 不会从 nil channel 收到数据
+func idleTicker() <-chan time.Time {
+	if idleTimeout <= 0 {
+		return nil
+	}
+	return time.NewTicker(max(idleTimeout/10, time.Second)).C
+}
+
+// idleExempt 判断用户是否不受空闲断开限制：管理员和在握手元数据中声明了 bot 能力的客户端
+// IDLE_KICK_EXEMPT=false 时所有人一视同仁
+func idleExempt(user *User) bool {
+	return idleKickExempt && (user.IsAdmin.Load() || user.hasCapability("bot"))
+}
+
+// kickIdle 在 broadcaster 中断开超过 IDLE_TIMEOUT 没有输入的用户，连接关闭后由读 goroutine 走正常的离开流程
+func kickIdle(users map[*User]struct{}, now time.Time) {
+	for user := range users {
+		if user.kicked || idleExempt(user) || now.Sub(user.lastActive()) < idleTimeout {
+			continue
+		}
+		user.kicked = true
+		infof("用户长时间未活动，断开连接：%s %s", user.Addr, user.NickName)
+		audit(user.Addr, "idle-disconnect", user.NickName)
+		go user.disconnect("长时间未活动，已断开")
+	}
+}
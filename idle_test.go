@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleKickExemptsAdmin(t *testing.T) {
+	tests := []struct {
+		name        string
+		exempt      bool
+		adminKicked bool
+	}{
+		{"管理员不受限制", true, false},
+		{"严格模式下管理员也会被断开", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 空闲检查的间隔至少 1 秒，超时时间取得很短，下一次检查时两个人都已经超时
+			setConfig(t, &idleTimeout, 200*time.Millisecond)
+			setConfig(t, &idleKickExempt, tt.exempt)
+			setConfig(t, &adminPassword, "pw")
+			ts := startServer(t)
+			alice := ts.join("alice")
+			alice.send("/admin pw")
+			alice.expect("已获得管理员权限")
+			bob := ts.join("bob")
+
+			expectIdleKick(t, bob)
+			if tt.adminKicked {
+				// 两个人在同一次检查中被断开，alice 不一定能收到 bob 的离开提醒
+				expectIdleKick(t, alice)
+				return
+			}
+			alice.expect("bob` has left")
+			// 再等过一次检查，管理员仍然在线
+			alice.collect(1200 * time.Millisecond)
+			alice.send("still here")
+			alice.expect("alice: still here")
+		})
+	}
+}
+
+// expectIdleKick 等待连接因为空闲被断开
+func expectIdleKick(t *testing.T, c *testClient) {
+	t.Helper()
+	lines := c.expectClosed()
+	if len(lines) == 0 || lines[len(lines)-1] != "长时间未活动，已断开" {
+		t.Errorf("因空闲被断开前收到 %q", lines)
+	}
+}
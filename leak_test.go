@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+// verifyNoLeak 在测试的所有清理（包括关闭服务）完成后检查是否有 goroutine 泄露，需在 startServer 之前调用
+func verifyNoLeak(t *testing.T) {
+	ignore := goleak.IgnoreCurrent()
+	t.Cleanup(func() { goleak.VerifyNone(t, ignore) })
+}
+
+func TestNoGoroutineLeak(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, ts *testServer)
+	}{
+		{"进入后离开", func(t *testing.T, ts *testServer) {
+			alice := ts.join("alice")
+			for _, nick := range []string{"bob", "carol", "dave"} {
+				c := ts.join(nick)
+				alice.expect(nick + "` has enter")
+				c.send("hi")
+				alice.expect(nick + ": hi")
+				c.close()
+				alice.expect(nick + "` has left")
+			}
+		}},
+		{"输入昵称前断开", func(t *testing.T, ts *testServer) {
+			c := ts.connect("")
+			c.expect("请输入你的昵称")
+			c.close()
+			c.expectClosed()
+		}},
+		{"消息发到一半断开", func(t *testing.T, ts *testServer) {
+			alice := ts.join("alice")
+			bob := ts.join("bob")
+			alice.expect("bob` has enter")
+			io.WriteString(bob.conn, "half a mess")
+			bob.close()
+			alice.expect("bob` has left")
+		}},
+		{"在线时关闭服务", func(t *testing.T, ts *testServer) {
+			alice := ts.join("alice")
+			ts.join("bob")
+			alice.expect("bob` has enter")
+			ts.stop()
+			alice.expect("服务器正在关闭")
+			alice.expectClosed()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifyNoLeak(t)
+			tt.run(t, startServer(t))
+		})
+	}
+}
+
+// logBuffer 收集日志，写 goroutine 和测试会同时访问，需要加锁
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestCloseBeforeNickname(t *testing.T) {
+	logs := &logBuffer{}
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	verifyNoLeak(t)
+	ts := startServer(t)
+
+	// 连昵称提示都不读就断开，写 goroutine 正阻塞在发送提示上
+	ts.listener.dial(t, "").Close()
+	deadline := time.Now().Add(testTimeout)
+	for !strings.Contains(logs.String(), "连接在进入聊天室前断开") {
+		if time.Now().After(deadline) {
+			t.Fatalf("日志中没有记录提前断开：%s", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
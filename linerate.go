@@ -0,0 +1,23 @@
+package main
+
+import "time"
+
+// lineRate 统计单个连接在一个短窗口内读到的行数，作为普通限流之外的最后一道防线，
+// 超过 LINE_RATE_LIMIT 的连接多半是失控的客户端，只在读 goroutine 中使用
+type lineRate struct {
+	windowStart time.Time
+	count       int
+}
+
+// allow 记录一行输入，当前窗口内的行数超过上限时返回 false；上限为 0 表示不限制
+func (r *lineRate) allow(now time.Time) bool {
+	if lineRateLimit <= 0 {
+		return true
+	}
+	if now.Sub(r.windowStart) >= lineRateWindow {
+		r.windowStart = now
+		r.count = 0
+	}
+	r.count++
+	return r.count <= lineRateLimit
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// listenTCP 监听 TCP 地址；非 Unix 系统不支持指定 backlog，总是使用系统默认值
+func listenTCP(addr string, backlog int) (net.Listener, error) {
+	if backlog > 0 {
+		warnf("当前系统不支持 LISTEN_BACKLOG，使用系统默认值")
+	}
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,56 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenTCP 监听 TCP 地址，backlog 大于 0 时使用该值作为连接队列长度，否则使用系统默认值（Linux 上为 somaxconn）
+// 标准库的 net.Listen 不能指定 backlog，这里自己创建 socket 后交给 net.FileListener；
+// 系统会把超过 somaxconn 的值截断，需要更大的队列时要同时调整内核参数
+func listenTCP(addr string, backlog int) (net.Listener, error) {
+	if backlog <= 0 {
+		return net.Listen("tcp", addr)
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// net.Listen 会把 0.0.0.0 当作双栈监听，这里按字面意思只监听 IPv4
+	family, sa := syscall.AF_INET6, syscall.Sockaddr(nil)
+	if ip4 := tcpAddr.IP.To4(); ip4 != nil || tcpAddr.IP == nil {
+		family = syscall.AF_INET
+		sa4 := &syscall.SockaddrInet4{Port: tcpAddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{Port: tcpAddr.Port}
+		copy(sa6.Addr[:], tcpAddr.IP.To16())
+		sa = sa6
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), "listener")
+	// FileListener 会复制一份描述符，这里的副本用完即关
+	defer f.Close()
+
+	// 和 net.Listen 一样允许服务重启后立即重新绑定端口
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return net.FileListener(f)
+}
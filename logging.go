@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// 日志级别，低于当前级别的日志不输出
+const (
+	levelDebug int32 = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// 当前的日志级别，启动时由 LOG_LEVEL 设置，管理员可以通过 /loglevel 随时调整，各个 goroutine 都会读取，所以使用 atomic
+// 启动阶段和 log.Fatal 等致命错误不受级别影响，总是输出
+var logLevel atomic.Int32
+
+// parseLogLevel 解析日志级别的名称
+func parseLogLevel(name string) (int32, bool) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return int32(i), true
+		}
+	}
+	return 0, false
+}
+
+// logf 按级别输出日志，info 级别与原来的输出格式相同，其他级别在前面加上 [DEBUG]、[WARN] 等标记
+func logf(level int32, format string, v ...any) {
+	if level < logLevel.Load() {
+		return
+	}
+	prefix := ""
+	if level != levelInfo {
+		prefix = "[" + strings.ToUpper(levelNames[level]) + "] "
+	}
+	// 调用深度为 3：log.Output -> logf -> debugf 等 -> 调用方
+	log.Output(3, prefix+fmt.Sprintf(format, v...))
+}
+
+func debugf(format string, v ...any) { logf(levelDebug, format, v...) }
+func infof(format string, v ...any)  { logf(levelInfo, format, v...) }
+func warnf(format string, v ...any)  { logf(levelWarn, format, v...) }
+func errorf(format string, v ...any) { logf(levelError, format, v...) }
+
+// logLevelCommand 查看或调整日志级别，仅管理员可用
+// 用法：/loglevel [debug|info|warn|error]
+func logLevelCommand(user *User, args string) {
+	if !requireAdmin(user) {
+		return
+	}
+	if args == "" {
+		user.notify("当前日志级别：" + levelNames[logLevel.Load()])
+		return
+	}
+	level, ok := parseLogLevel(args)
+	if !ok {
+		user.notify("用法：/loglevel debug|info|warn|error")
+		return
+	}
+	logLevel.Store(level)
+	// 用新的级别记录这次调整，确认设置已经生效
+	logf(level, "%s 将日志级别设置为 %s", user.NickName, levelNames[level])
+	audit(user.Addr, "loglevel", levelNames[level])
+	user.notify("日志级别已设置为 " + levelNames[level])
+}
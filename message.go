@@ -0,0 +1,198 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 消息类型，JSON 模式下对应 type 字段
+const (
+	// 用户发送的普通聊天消息
+	KindChat = "chat"
+	// 进入、离开等需要广播的系统消息
+	KindSystem = "system"
+	// 私信
+	KindPrivate = "private"
+	// 只发给单个用户的提示，如命令的回复
+	KindNotice = "notice"
+	// 编辑、删除之前发送的消息，Ref 为被修改消息的序号
+	KindEdit   = "edit"
+	KindDelete = "delete"
+	// 添加、取消对消息的回应，Ref 为被回应消息的序号
+	KindReact   = "react"
+	KindUnreact = "unreact"
+	// 在线用户列表的完整快照和增量，只发给订阅了列表推送的 JSON 客户端
+	KindRoster       = "roster"
+	KindRosterAdd    = "roster_add"
+	KindRosterRemove = "roster_remove"
+	// 迁移到另一台服务器的通知，Addr 为新地址
+	KindRedirect = "redirect"
+	// 版本握手的回复，总是以 JSON 发送
+	KindHello = "hello"
+)
+
+// Message 发送给客户端的消息
+type Message struct {
+	// 广播序号，由 broadcaster 分配、严格递增，客户端可据此发现漏收的消息；非广播消息和进入、离开提醒为 0
+	Seq  int64  `json:"seq,omitempty"`
+	Kind string `json:"type"`
+	// 发送者昵称，系统消息和提示为空
+	From    string    `json:"from,omitempty"`
+	Content string    `json:"text"`
+	Time    time.Time `json:"time"`
+	// 被引用的消息，格式为 "发送者: 内容"，为空表示没有引用
+	Quote string `json:"quote,omitempty"`
+	// 是否为机器人发送的消息
+	Bot bool `json:"bot,omitempty"`
+	// 编辑、删除等事件指向的消息序号
+	Ref int64 `json:"ref,omitempty"`
+	// 回复的消息序号，为 0 表示不是回复
+	ReplyTo int64 `json:"reply_to,omitempty"`
+	// 消息是否被编辑过
+	Edited bool `json:"edited,omitempty"`
+	// 回应事件的表情，以及被回应消息当前每个表情的回应人数
+	Emoji     string         `json:"emoji,omitempty"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+	// 在线用户列表及其版本号
+	Users     []string `json:"users,omitempty"`
+	RosterSeq int64    `json:"roster_seq,omitempty"`
+	// redirect 中的新服务器地址和该用户的断线重连令牌
+	Addr  string `json:"addr,omitempty"`
+	Token string `json:"token,omitempty"`
+	// hello 中的协议版本和协商结果
+	Version  int      `json:"version,omitempty"`
+	Features []string `json:"features,omitempty"`
+
+	// 发送消息的用户，系统消息和机器人消息为 nil，不会发给客户端
+	sender *User
+	// 被回复消息的发送者，由 broadcaster 根据 ReplyTo 在聊天记录中查找
+	replyNick string
+	// 是否为进入、离开提醒，开启 /quiet 的用户不会收到
+	presence bool
+	// 写 goroutine 发出这条消息后开始压缩输出
+	startDeflate bool
+	// 文本模式下广播行的前后缀（BROADCAST_PREFIX/BROADCAST_SUFFIX），由 broadcast 生成
+	linePrefix, lineSuffix string
+}
+
+// newMessage 创建一条广播消息，from 为空时为系统消息
+func newMessage(from, content string) *Message {
+	kind := KindChat
+	if from == "" {
+		kind = KindSystem
+	}
+	return &Message{
+		Kind:    kind,
+		From:    from,
+		Content: content,
+		Time:    time.Now(),
+	}
+}
+
+// newPresence 创建一条进入或离开提醒
+func newPresence(content string) *Message {
+	msg := newMessage("", content)
+	msg.presence = true
+	return msg
+}
+
+// newUserMessage 创建一条由用户发送的聊天消息
+func newUserMessage(user *User, content string) *Message {
+	msg := newMessage(user.NickName, content)
+	msg.sender = user
+	return msg
+}
+
+// newNotice 创建一条只发给单个用户的提示
+func newNotice(content string) *Message {
+	return &Message{
+		Kind:    KindNotice,
+		Content: content,
+		Time:    time.Now(),
+	}
+}
+
+// String 返回消息的文本形式，引用和聊天记录等都使用这个格式
+func (m *Message) String() string {
+	return m.render(false)
+}
+
+// Text 返回发送给文本模式客户端的内容，依次进行以下处理：
+//  1. render 生成给人看的内容：昵称、引用、私信标记等，plain 为 false 时同时着色
+//  2. plain 为 true 时去掉所有 ANSI 控制序列，消息内容里用户自带的也会去掉
+//  3. 开启 SEQ_PREFIX 时在广播消息前加上 "#序号 "
+//  4. 在最外层加上 BROADCAST_PREFIX/BROADCAST_SUFFIX，只用于广播消息，前后缀本身不会被去色；
+//     引用回复、投票等多行消息的每一行都加，客户端按行显示时每行都能看出来源
+//
+// 最后由写 goroutine 追加消息分隔符；JSON 模式不经过这些处理
+func (m *Message) Text(plain bool) string {
+	var s string
+	if plain {
+		s = stripANSI(m.render(false))
+	} else {
+		s = m.render(true)
+	}
+	if seqPrefix && m.Seq > 0 {
+		s = "#" + formatSeq(m.Seq) + " " + s
+	}
+	if m.linePrefix == "" && m.lineSuffix == "" {
+		return s
+	}
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = m.linePrefix + line + m.lineSuffix
+	}
+	return strings.Join(lines, "\n")
+}
+
+// render 生成消息的文本形式，color 为 true 时昵称按人着色，系统消息和引用为灰色
+func (m *Message) render(color bool) string {
+	gray := func(s string) string {
+		if color {
+			return ansiGray + s + ansiReset
+		}
+		return s
+	}
+
+	switch m.Kind {
+	case KindSystem:
+		return gray(m.Content)
+	case KindDelete:
+		return gray("（" + m.From + " 删除了一条消息）")
+	case KindReact:
+		return gray(m.From + " (+1 " + m.Emoji + ") #" + formatSeq(m.Ref))
+	case KindUnreact:
+		return gray(m.From + " (-1 " + m.Emoji + ") #" + formatSeq(m.Ref))
+	}
+
+	s := m.Content
+	if color && strings.Contains(s, "\x1b") {
+		// 消息里自带的颜色不要影响到后面的输出
+		s += ansiReset
+	}
+	if m.ReplyTo != 0 {
+		s = "回复 @" + m.replyNick + ": " + s
+	}
+	if m.From != "" {
+		nick := m.From
+		if color {
+			nick = colorNick(nick)
+		}
+		s = nick + ": " + s
+	}
+	if m.Edited {
+		s += "（已编辑）"
+	}
+	if m.Kind == KindPrivate {
+		s = "[私信] " + s
+	}
+	if m.Quote != "" {
+		s = gray("> "+m.Quote) + "\n" + s
+	}
+	return s
+}
+
+func formatSeq(seq int64) string {
+	return strconv.FormatInt(seq, 10)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// 迁移到另一台服务器：管理员执行 /migrate <host:port> 后，broadcaster 广播迁移通知，并给每个在线用户发送一条 redirect：
+//
+//	{"type":"redirect","text":"...","time":"...","addr":"chat2.example.com:2020","token":"..."}
+//
+// 文本模式的客户端看到的是 text 中的新地址。MIGRATE_DELAY 之后断开所有连接，期间进入的新用户会被拒绝。
+// token 为该用户的断线重连令牌（未开启断线重连时为空），只有新服务器能识别这个令牌时才能凭它找回昵称，
+// 否则客户端应当改用原来的昵称重新进入
+
+// migrateRequest 管理员发起迁移
+type migrateRequest struct {
+	User *User
+	Addr string
+}
+
+// migrateCommand 处理 /migrate <host:port>
+func migrateCommand(user *User, args string) {
+	if !requireAdmin(user) {
+		return
+	}
+	if _, _, err := net.SplitHostPort(args); err != nil {
+		user.notify("用法：/migrate <主机:端口>")
+		return
+	}
+	submit(user.srv, user.srv.migrateChannel, migrateRequest{User: user, Addr: args})
+}
+
+// handleMigrate 在 broadcaster 中开始迁移，返回新地址和断开所有连接的定时器；已经在迁移时不做任何改变
+func (s *Server) handleMigrate(users map[*User]struct{}, addr string, timer <-chan time.Time, req migrateRequest) (string, <-chan time.Time) {
+	if addr != "" {
+		req.User.tell("已经在迁移到 " + addr)
+		return addr, timer
+	}
+	audit(req.User.Addr, "migrate", req.Addr)
+	infof("%s 开始迁移到 %s，%v 后断开所有连接", req.User.NickName, req.Addr, migrateDelay)
+	s.broadcast(users, newMessage("", "🚚 服务器即将迁移到 "+req.Addr))
+	for user := range users {
+		if user.ResumeToken != "" {
+			user.TokenShown.Store(true)
+		}
+		user.deliver(&Message{
+			Kind:    KindRedirect,
+			Content: "请在 " + migrateDelay.String() + " 内重新连接到 " + req.Addr,
+			Time:    time.Now(),
+			Addr:    req.Addr,
+			Token:   user.ResumeToken,
+		})
+	}
+	return req.Addr, time.After(migrateDelay)
+}
+
+// finishMigrate 迁移等待结束，断开所有在线用户和镜像连接
+func (s *Server) finishMigrate(users map[*User]struct{}, addr string) {
+	for _, group := range []map[*User]struct{}{users, s.mirrors} {
+		for user := range group {
+			if user.kicked {
+				continue
+			}
+			user.kicked = true
+			go user.disconnect("服务器已迁移到 " + addr)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+)
+
+// mirrorRequest 镜像连接登记或离开
+type mirrorRequest struct {
+	User *User
+	Join bool
+}
+
+// checkMirrorToken 校验镜像令牌，未配置 MIRROR_TOKEN 时不允许镜像连接
+func checkMirrorToken(token string) bool {
+	if mirrorToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(mirrorToken)) == 1
+}
+
+// handleMirror 在 broadcaster 中登记或移除镜像连接
+func (s *Server) handleMirror(req mirrorRequest) {
+	if req.Join {
+		s.mirrors[req.User] = struct{}{}
+		req.User.tell("已作为只读镜像接入，将收到聊天室的所有广播")
+		return
+	}
+	delete(s.mirrors, req.User)
+	close(req.User.MessageChannel)
+}
+
+// serveMirror 以只读镜像的身份处理连接：登记后只接收广播，输入一律忽略，连接断开时移除
+func serveMirror(user *User, input *bufio.Scanner, abort func()) {
+	audit(user.Addr, "mirror", "")
+	if !submit(user.srv, user.srv.mirrorChannel, mirrorRequest{User: user, Join: true}) {
+		abort()
+		return
+	}
+	user.srv.admitConn(user.conn)
+
+	for input.Scan() {
+		user.notify("镜像连接为只读，输入已忽略")
+	}
+
+	audit(user.Addr, "disconnect", "mirror")
+	if !submit(user.srv, user.srv.mirrorChannel, mirrorRequest{User: user}) {
+		abort()
+	}
+}
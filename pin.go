@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 置顶内容的最大显示宽度
+const maxPinWidth = 200
+
+// pinRequest 管理员置顶或取消置顶，Seq 不为 0 时置顶聊天记录中的这条消息，否则置顶 Text
+type pinRequest struct {
+	User  *User
+	Text  string
+	Seq   int64
+	Unpin bool
+}
+
+// pinCommand 处理 /pin <内容>|<序号>，参数为纯数字时视为消息序号
+func pinCommand(user *User, args string) {
+	if !requireAdmin(user) {
+		return
+	}
+	if args == "" {
+		user.notify("用法：/pin <内容>|<消息序号>")
+		return
+	}
+	if seq, err := strconv.ParseInt(args, 10, 64); err == nil && seq > 0 {
+		submit(user.srv, user.srv.pinChannel, pinRequest{User: user, Seq: seq})
+		return
+	}
+	submit(user.srv, user.srv.pinChannel, pinRequest{User: user, Text: args})
+}
+
+// handlePin 在 broadcaster 中更新置顶内容并广播，返回新的置顶内容，新用户进入时在 MOTD 之后显示
+func (s *Server) handlePin(users map[*User]struct{}, history []*Message, pinned string, req pinRequest) string {
+	if req.Unpin {
+		if pinned == "" {
+			req.User.tell("当前没有置顶内容")
+			return pinned
+		}
+		audit(req.User.Addr, "unpin", "")
+		s.broadcast(users, newMessage("", "📌 已取消置顶"))
+		return ""
+	}
+
+	text := req.Text
+	if req.Seq != 0 {
+		i := findHistory(history, req.Seq)
+		if i < 0 {
+			req.User.tell("找不到消息 #" + formatSeq(req.Seq) + "，可能已超出聊天记录范围")
+			return pinned
+		}
+		text = history[i].From + ": " + history[i].Content
+	}
+	// 置顶内容只占一行
+	text, _ = truncateDisplay(strings.Join(strings.Fields(text), " "), maxPinWidth)
+	audit(req.User.Addr, "pin", text)
+	s.broadcast(users, newMessage("", "📌 已置顶："+text))
+	return text
+}
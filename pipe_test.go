@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试中等待一行输出、一次连接等操作的最长时间
+const testTimeout = 2 * time.Second
+
+func TestMain(m *testing.M) {
+	// 不读取 .env 和环境变量之外的任何配置，所有测试都从默认值开始
+	loadConfig()
+	// 去掉 ANSI 颜色，方便按内容匹配
+	colorEnabled = false
+	if err := parseTemplates(); err != nil {
+		panic(err)
+	}
+	var err error
+	if authenticator, err = newAuthenticator(authMode, authPassword, authFilePath); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// setConfig 在当前测试中修改一项配置，测试结束后恢复原值
+func setConfig[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// pipeAddr 模拟的远端地址，用来测试按 IP 的准入检查
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "tcp" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// addrConn 替换 net.Pipe 的远端地址，net.Pipe 本身的地址没有 IP
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+// pipeListener 内存中的 net.Listener：每次 dial 用 net.Pipe 创建一对连接，服务端一端交给 Accept
+// net.Pipe 没有缓冲，客户端不读时服务端的写操作会一直阻塞，和真实网络中对端不读数据的情况一样
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr("pipe") }
+
+// dial 模拟来自 addr 的一个新连接，返回客户端一端；addr 为空时连接没有 IP，不受按 IP 的限制
+func (l *pipeListener) dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	if addr != "" {
+		server = addrConn{Conn: server, addr: pipeAddr(addr)}
+	}
+	select {
+	case l.conns <- server:
+	case <-time.After(testTimeout):
+		t.Fatal("服务端没有接受连接")
+	}
+	return client
+}
+
+// testServer 在内存中运行的 Server，测试结束时走正常的关闭流程
+type testServer struct {
+	*Server
+	t        *testing.T
+	listener *pipeListener
+	served   chan struct{}
+	stopOnce sync.Once
+}
+
+// startServer 启动 broadcaster 和 accept 循环
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+	return startServerOn(t, nil)
+}
+
+// startServerOn 同 startServer，wrap 不为空时 serve 使用包装后的 listener，用来注入 Accept 错误
+func startServerOn(t *testing.T, wrap func(net.Listener) net.Listener) *testServer {
+	t.Helper()
+	ts := &testServer{Server: newServer(), t: t, listener: newPipeListener(), served: make(chan struct{})}
+	var listener net.Listener = ts.listener
+	if wrap != nil {
+		listener = wrap(listener)
+	}
+	go ts.broadcaster()
+	go func() {
+		ts.serve(listener)
+		close(ts.served)
+	}()
+	t.Cleanup(ts.stop)
+	return ts
+}
+
+// stop 通知 broadcaster 关闭并关闭 listener，等所有连接退出，可以重复调用
+func (ts *testServer) stop() {
+	ts.stopOnce.Do(func() {
+		ts.shutdown()
+		ts.listener.Close()
+		if !ts.waitConns(testTimeout) {
+			ts.t.Error("关闭服务后连接没有及时退出")
+		}
+		for _, ch := range []chan struct{}{ts.broadcasterDone, ts.served} {
+			select {
+			case <-ch:
+			case <-time.After(testTimeout):
+				ts.t.Error("关闭服务后 broadcaster 或 accept 循环没有退出")
+			}
+		}
+	})
+}
+
+// connect 建立一个新连接，addr 含义同 dial
+func (ts *testServer) connect(addr string) *testClient {
+	ts.t.Helper()
+	return newTestClient(ts.t, ts.listener.dial(ts.t, addr))
+}
+
+// join 建立连接并以 nick 进入聊天室，收到欢迎信息后返回
+func (ts *testServer) join(nick string) *testClient {
+	ts.t.Helper()
+	c := ts.connect("")
+	c.expect("请输入你的昵称")
+	c.send(nick)
+	c.expect("欢迎你的到来")
+	return c
+}
+
+// testClient 测试用的客户端，后台持续按行读取服务端发来的内容，服务端不会因为测试没有及时读取而阻塞
+type testClient struct {
+	t     *testing.T
+	conn  net.Conn
+	lines chan string
+	// 测试已经读取过的所有行
+	received []string
+}
+
+func newTestClient(t *testing.T, conn net.Conn) *testClient {
+	c := &testClient{t: t, conn: conn, lines: make(chan string, 1024)}
+	go func() {
+		defer close(c.lines)
+		input := bufio.NewScanner(conn)
+		for input.Scan() {
+			c.lines <- input.Text()
+		}
+	}()
+	t.Cleanup(c.close)
+	return c
+}
+
+// send 发送一行输入
+func (c *testClient) send(line string) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, err := io.WriteString(c.conn, line+"\n"); err != nil {
+		c.t.Fatalf("发送 %q 失败：%v", line, err)
+	}
+}
+
+// expect 读取输出直到出现包含 substr 的一行并返回该行，超时或连接关闭时测试失败
+func (c *testClient) expect(substr string) string {
+	c.t.Helper()
+	timer := time.NewTimer(testTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				c.t.Fatalf("等待 %q 时连接已关闭", substr)
+			}
+			c.received = append(c.received, line)
+			if strings.Contains(line, substr) {
+				return line
+			}
+		case <-timer.C:
+			c.t.Fatalf("等待 %q 超时", substr)
+		}
+	}
+}
+
+// collect 返回 d 内收到的所有行
+func (c *testClient) collect(d time.Duration) []string {
+	var lines []string
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				return lines
+			}
+			lines = append(lines, line)
+			c.received = append(c.received, line)
+		case <-timer.C:
+			return lines
+		}
+	}
+}
+
+// expectClosed 等待服务端关闭连接，返回关闭前收到的所有行
+func (c *testClient) expectClosed() []string {
+	c.t.Helper()
+	var lines []string
+	timer := time.NewTimer(testTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				return lines
+			}
+			lines = append(lines, line)
+			c.received = append(c.received, line)
+		case <-timer.C:
+			c.t.Fatal("服务端没有关闭连接")
+		}
+	}
+}
+
+// close 从客户端一侧断开连接
+func (c *testClient) close() {
+	c.conn.Close()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type pollAction int
+
+// 投票问题和每个选项的最大显示宽度，以及最多的选项数，避免一条 /poll 广播出超长的内容
+const (
+	maxPollQuestionWidth = 200
+	maxPollOptionWidth   = 50
+	maxPollOptions       = 10
+)
+
+const (
+	pollOpen pollAction = iota
+	pollVote
+	pollResults
+	pollClose
+)
+
+// pollRequest 投票相关的操作，统一交给 broadcaster 处理，避免对投票状态加锁
+type pollRequest struct {
+	User     *User
+	Action   pollAction
+	Question string
+	Options  []string
+	// 投票选项，从 1 开始
+	Choice int
+}
+
+// poll 当前进行中的投票，同一时间只能有一个
+// 发起人和管理员可以结束投票，发起人离开时自动结束
+type poll struct {
+	Creator  string
+	creator  *User
+	Question string
+	Options  []string
+	// 昵称 -> 选项下标，重复投票时覆盖之前的选择
+	Votes map[string]int
+}
+
+func (p *poll) results() string {
+	counts := make([]int, len(p.Options))
+	for _, choice := range p.Votes {
+		counts[choice]++
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "投票：%s（共 %d 票）", p.Question, len(p.Votes))
+	for i, opt := range p.Options {
+		fmt.Fprintf(&b, "\n%d. %s - %d 票", i+1, opt, counts[i])
+	}
+	return b.String()
+}
+
+// handlePoll 在 broadcaster 中执行投票操作
+func (s *Server) handlePoll(active **poll, req pollRequest, users map[*User]struct{}) {
+	p := *active
+	reply := req.User.tell
+
+	switch req.Action {
+	case pollOpen:
+		if p != nil {
+			reply("已有进行中的投票，请先使用 /poll-close 结束")
+			return
+		}
+		p = &poll{
+			Creator:  req.User.NickName,
+			creator:  req.User,
+			Question: req.Question,
+			Options:  req.Options,
+			Votes:    make(map[string]int),
+		}
+		*active = p
+		s.broadcast(users, newMessage("", req.User.NickName+" 发起了投票，使用 /vote <n> 参与\n"+p.results()))
+	case pollVote:
+		if p == nil {
+			reply("当前没有进行中的投票")
+			return
+		}
+		if req.Choice < 1 || req.Choice > len(p.Options) {
+			reply("没有选项 " + strconv.Itoa(req.Choice) + "，可选 1-" + strconv.Itoa(len(p.Options)))
+			return
+		}
+		_, revote := p.Votes[req.User.NickName]
+		p.Votes[req.User.NickName] = req.Choice - 1
+		if revote {
+			reply("已修改投票为：" + p.Options[req.Choice-1])
+		} else {
+			reply("已投票：" + p.Options[req.Choice-1])
+		}
+	case pollResults:
+		if p == nil {
+			reply("当前没有进行中的投票")
+			return
+		}
+		reply(p.results())
+	case pollClose:
+		if p == nil {
+			reply("当前没有进行中的投票")
+			return
+		}
+		if p.creator != req.User && !req.User.IsAdmin.Load() {
+			reply("只有发起人 " + p.Creator + " 或管理员可以结束投票")
+			return
+		}
+		*active = nil
+		s.broadcast(users, newMessage("", "投票已结束\n"+p.results()))
+	}
+}
+
+// closePollOf 在 broadcaster 中处理用户离开：该用户发起的投票随之结束，否则就再也没有人能结束它
+func (s *Server) closePollOf(active **poll, user *User, users map[*User]struct{}) {
+	p := *active
+	if p == nil || p.creator != user {
+		return
+	}
+	*active = nil
+	s.broadcast(users, newMessage("", "发起人已离开，投票已结束\n"+p.results()))
+}
+
+// parsePoll 解析 /poll 的参数：`"问题" 选项1 选项2 ...`，问题不含空格时可以省略引号
+// 问题和选项超出宽度时截断，选项超过 maxPollOptions 个时视为格式错误
+func parsePoll(args string) (question string, options []string, ok bool) {
+	if strings.HasPrefix(args, `"`) {
+		end := strings.Index(args[1:], `"`)
+		if end < 0 {
+			return "", nil, false
+		}
+		question = strings.TrimSpace(args[1 : end+1])
+		options = strings.Fields(args[end+2:])
+	} else {
+		fields := strings.Fields(args)
+		if len(fields) == 0 {
+			return "", nil, false
+		}
+		question, options = fields[0], fields[1:]
+	}
+	if question == "" || len(options) < 2 || len(options) > maxPollOptions {
+		return "", nil, false
+	}
+	question, _ = truncateDisplay(question, maxPollQuestionWidth)
+	for i, opt := range options {
+		options[i], _ = truncateDisplay(opt, maxPollOptionWidth)
+	}
+	return question, options, true
+}
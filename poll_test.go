@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPollDuringMaintenance(t *testing.T) {
+	setConfig(t, &adminPassword, "pw")
+	ts := startServer(t)
+	alice := joinAdmin(ts, "alice")
+	bob := ts.join("bob")
+
+	alice.send("/maintenance on")
+	bob.expect("进入维护模式")
+	bob.send(`/poll "SPAM question" a b`)
+	bob.expect("服务器维护中，无法发起投票")
+	for _, line := range alice.collect(200 * time.Millisecond) {
+		if strings.Contains(line, "SPAM") {
+			t.Errorf("维护模式下广播了普通用户发起的投票：%q", line)
+		}
+	}
+
+	// 管理员仍然可以发起投票
+	alice.send(`/poll "去哪吃" 食堂 外卖`)
+	bob.expect("投票：去哪吃")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// userPrefs 按昵称保存的个人设置，下次进入聊天室时恢复
+// 只保存服务端的设置：/plain 和 /quiet；客户端的别名由客户端自己保存
+type userPrefs struct {
+	Plain bool `json:"plain"`
+	Quiet bool `json:"quiet"`
+}
+
+// 所有昵称的个人设置，保存在 PREFS_FILE 中，各个连接的读 goroutine 都会访问，需要加锁
+// 未配置 PREFS_FILE 时为 nil，不保存
+var (
+	prefs      map[string]userPrefs
+	prefsMutex sync.Mutex
+)
+
+// loadPrefs 读取个人设置文件，文件不存在时从空开始
+func loadPrefs(path string) error {
+	prefs = make(map[string]userPrefs)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &prefs)
+}
+
+// canKeepPrefs 是否可以为这个用户保存个人设置：只有认证方式能确认昵称归属时才保存，
+// 否则任何人都可以用别人的昵称进入，读到或改掉别人的设置
+func canKeepPrefs(user *User) bool {
+	return prefs != nil && user.Authenticated
+}
+
+// restorePrefs 登记前恢复用户保存过的个人设置
+func restorePrefs(user *User) {
+	if !canKeepPrefs(user) {
+		return
+	}
+	prefsMutex.Lock()
+	p, ok := prefs[user.NickName]
+	prefsMutex.Unlock()
+	if ok {
+		user.Plain.Store(p.Plain)
+		user.Quiet.Store(p.Quiet)
+	}
+}
+
+// savePrefs 在用户修改设置后保存，写入临时文件后再替换，避免写到一半时文件损坏
+func savePrefs(user *User) {
+	if !canKeepPrefs(user) {
+		return
+	}
+	prefsMutex.Lock()
+	defer prefsMutex.Unlock()
+	prefs[user.NickName] = userPrefs{Plain: user.Plain.Load(), Quiet: user.Quiet.Load()}
+	data, err := json.MarshalIndent(prefs, "", "  ")
+	if err == nil {
+		tmp := prefsPath + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, prefsPath)
+		}
+	}
+	if err != nil {
+		warnf("保存个人设置失败：%v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import "strconv"
+
+// privateMessage 私信，由 broadcaster 根据昵称查找接收者并投递
+type privateMessage struct {
+	From    *User
+	To      string
+	Content string
+}
+
+// awayRequest 设置或取消离开状态
+// 回来时 broadcaster 通过 Pending 交回离开期间收到的私信，由读 goroutine 逐条放进发送队列，
+// 待收消息可能比发送队列还多，不能在 broadcaster 中投递
+type awayRequest struct {
+	User    *User
+	Away    bool
+	Note    string
+	Pending chan []*Message
+}
+
+// findUser 按昵称查找在线用户，只能在 broadcaster 中调用
+func findUser(users map[*User]struct{}, nickName string) *User {
+	for user := range users {
+		if user.NickName == nickName {
+			return user
+		}
+	}
+	return nil
+}
+
+// handlePrivate 在 broadcaster 中投递私信，接收者处于离开状态时先放入其待收队列
+func handlePrivate(users map[*User]struct{}, pm privateMessage) {
+	to := findUser(users, pm.To)
+	if to == nil {
+		pm.From.tell("用户 " + pm.To + " 不在线")
+		return
+	}
+
+	msg := newMessage(pm.From.NickName, pm.Content)
+	msg.Kind = KindPrivate
+	if !to.Away {
+		to.deliver(msg)
+		pm.From.tell("[私信 -> " + to.NickName + "] " + pm.Content)
+		return
+	}
+
+	if len(to.PendingMessages) >= awayQueueSize {
+		pm.From.tell(to.NickName + " 暂时离开：" + to.AwayNote + "（待收消息已满，本条未送达）")
+		return
+	}
+	to.PendingMessages = append(to.PendingMessages, msg)
+	pm.From.tell(to.NickName + " 暂时离开：" + to.AwayNote + "（消息将在其回来后送达）")
+}
+
+// handleAway 在 broadcaster 中切换离开状态，回来时交回离开期间收到的私信
+func handleAway(req awayRequest) {
+	user := req.User
+	if req.Away {
+		user.Away = true
+		user.AwayNote = req.Note
+		user.tell("已设置为离开状态：" + req.Note + "，使用 /back 回来")
+		return
+	}
+
+	pending := user.PendingMessages
+	switch {
+	case !user.Away:
+		user.tell("你当前不是离开状态")
+	case len(pending) == 0:
+		user.tell("欢迎回来，离开期间没有收到消息")
+	default:
+		user.tell("欢迎回来，你离开期间收到 " + strconv.Itoa(len(pending)) + " 条消息：")
+	}
+	user.Away = false
+	user.AwayNote = ""
+	user.PendingMessages = nil
+	req.Pending <- pending
+}
+
+// backCommand 处理 /back：取消离开状态，并把离开期间收到的私信发给自己
+func backCommand(user *User) {
+	pending := make(chan []*Message, 1)
+	if !submit(user.srv, user.srv.awayChannel, awayRequest{User: user, Pending: pending}) {
+		return
+	}
+	for _, msg := range <-pending {
+		user.MessageChannel <- msg
+	}
+}
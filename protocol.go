@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// HTTP 请求行，如 "GET /chat HTTP/1.1"
+var httpRequestLine = regexp.MustCompile(`^[A-Z]+ \S+ HTTP/\d`)
+
+// wrongProtocol 根据连接的第一行判断客户端是否连错了端口或者用错了协议，是的话返回一行说明，否则返回空字符串
+// 只检查能明确识别的几种情况，其他输入按昵称或握手正常处理
+func wrongProtocol(line string, isWS bool) string {
+	// TLS 握手以 0x16 0x03 开头（ClientHello）
+	if strings.HasPrefix(line, "\x16\x03") {
+		return "协议错误：这是明文 TCP 端口，不支持 TLS"
+	}
+	if !isWS && httpRequestLine.MatchString(line) {
+		if wsListenAddr != "" {
+			return "协议错误：这是聊天室的 TCP 端口，HTTP/WebSocket 客户端请连接 " + wsListenAddr
+		}
+		return "协议错误：这是聊天室的 TCP 端口，不支持 HTTP/WebSocket"
+	}
+	// 进入聊天室前就发来事件，多半是客户端跳过了握手
+	if strings.HasPrefix(line, "{") {
+		var event struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal([]byte(line), &event) == nil && event.Type != "" {
+			return `协议错误：第一行应为昵称或握手，如 {"version":1,"nick":"alice","features":["json"]}，事件需在进入聊天室后发送`
+		}
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+package main
+
+// reactions 最近消息收到的回应，按消息序号、表情、回应者昵称记录，同一个人对同一条消息的同一个表情只算一次
+// 只保留仍在聊天记录中的消息，只在 broadcaster 中读写
+type reactions map[int64]map[string]map[string]struct{}
+
+// 表情最长的字节数，足够容纳带肤色、ZWJ 组合的 emoji
+const maxEmojiLen = 32
+
+// reactRequest 添加或取消对某条消息的回应
+type reactRequest struct {
+	User   *User
+	Seq    int64
+	Emoji  string
+	Remove bool
+}
+
+// counts 统计某条消息每个表情的回应人数
+func (r reactions) counts(seq int64) map[string]int {
+	counts := make(map[string]int, len(r[seq]))
+	for emoji, reactors := range r[seq] {
+		counts[emoji] = len(reactors)
+	}
+	return counts
+}
+
+// prune 删除已经不在聊天记录中的消息的回应
+func (r reactions) prune(history []*Message) {
+	for seq := range r {
+		if findHistory(history, seq) < 0 {
+			delete(r, seq)
+		}
+	}
+}
+
+// handleReact 在 broadcaster 中添加或取消回应，成功后广播带有最新统计的事件
+func (s *Server) handleReact(users map[*User]struct{}, history []*Message, r reactions, req reactRequest) {
+	r.prune(history)
+	if findHistory(history, req.Seq) < 0 {
+		req.User.tell("找不到消息 #" + formatSeq(req.Seq) + "，可能已超出聊天记录范围")
+		return
+	}
+
+	nick := req.User.NickName
+	reactors := r[req.Seq][req.Emoji]
+	_, reacted := reactors[nick]
+	if req.Remove {
+		if !reacted {
+			req.User.tell("你没有用 " + req.Emoji + " 回应过这条消息")
+			return
+		}
+		delete(reactors, nick)
+		if len(reactors) == 0 {
+			delete(r[req.Seq], req.Emoji)
+		}
+	} else {
+		if reacted {
+			req.User.tell("你已经用 " + req.Emoji + " 回应过这条消息")
+			return
+		}
+		if r[req.Seq] == nil {
+			r[req.Seq] = make(map[string]map[string]struct{})
+		}
+		if reactors == nil {
+			reactors = make(map[string]struct{})
+			r[req.Seq][req.Emoji] = reactors
+		}
+		reactors[nick] = struct{}{}
+	}
+
+	event := newUserMessage(req.User, "")
+	event.Kind = KindReact
+	if req.Remove {
+		event.Kind = KindUnreact
+	}
+	event.Ref = req.Seq
+	event.Emoji = req.Emoji
+	event.Reactions = r.counts(req.Seq)
+	s.broadcast(users, event)
+}
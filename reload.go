@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchReload 收到 SIGHUP 时重新加载机器人关键词和 MOTD 文件，交给 broadcaster 替换
+func watchReload(srv *Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if botEnabled {
+			if rules, err := loadBotRules(botRulesPath); err != nil {
+				warnf("重新加载机器人关键词失败：%v", err)
+			} else {
+				infof("已重新加载 %d 条机器人关键词", len(rules))
+				submit(srv, srv.botRulesChannel, rules)
+			}
+		}
+		if motdPath != "" {
+			if motd, err := loadMOTD(motdPath); err != nil {
+				warnf("重新加载 MOTD 失败：%v", err)
+			} else {
+				infof("已重新加载 MOTD")
+				submit(srv, srv.motdChannel, motd)
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Gemini 请求总次数，各个读 goroutine 都会发起请求，所以使用 atomic
+var geminiCalls atomic.Int64
+
+// roomStats 聊天室的累计数据，只在 broadcaster 中读写
+type roomStats struct {
+	// 启动以来转发的聊天消息条数
+	Messages int64
+	// 同时在线人数的最高值
+	Peak int
+}
+
+// handleRoomStats 在 broadcaster 中回复聊天室统计，未配置 Gemini 时不显示请求次数
+func (s *Server) handleRoomStats(users map[*User]struct{}, stats roomStats, user *User) {
+	var b strings.Builder
+	b.WriteString("聊天室统计：")
+	b.WriteString("\n消息总数：" + strconv.FormatInt(stats.Messages, 10))
+	b.WriteString("\n当前在线：" + strconv.Itoa(len(users)))
+	b.WriteString("\n最高在线：" + strconv.Itoa(stats.Peak))
+	b.WriteString("\n运行时长：" + time.Since(s.startedAt).Round(time.Second).String())
+	if geminiKey != "" {
+		b.WriteString("\nGemini 请求：" + strconv.FormatInt(geminiCalls.Load(), 10))
+	}
+	user.tell(b.String())
+}
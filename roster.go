@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// 在线用户列表的增量推送：在版本握手中同时协商了 json 和 roster 的客户端，进入时收到一份完整列表，
+// 之后每次有人进入或离开时只收到一条增量：
+//
+//	{"type":"roster","text":"","time":"...","roster_seq":7,"users":["alice","bob"]}
+//	{"type":"roster_add","from":"carol","text":"","time":"...","roster_seq":8}
+//	{"type":"roster_remove","from":"bob","text":"","time":"...","roster_seq":9}
+//
+// roster_seq 每次变化加一，客户端发现不连续时说明漏掉了增量，可以发送 {"type":"roster"} 重新获取完整列表。
+// 镜像连接不在列表中
+
+// rosterSnapshot 生成完整列表，昵称按字母排序
+func (s *Server) rosterSnapshot(users map[*User]struct{}) *Message {
+	names := make([]string, 0, len(users))
+	for user := range users {
+		names = append(names, user.NickName)
+	}
+	sort.Strings(names)
+	return &Message{Kind: KindRoster, Users: names, RosterSeq: s.rosterSeq, Time: time.Now()}
+}
+
+// sendRoster 给订阅了列表推送、当前处于 JSON 模式的用户发送列表消息
+func sendRoster(user *User, msg *Message) {
+	if user.Roster && user.JSONMode.Load() {
+		user.deliver(msg)
+	}
+}
+
+// rosterChanged 在 broadcaster 中记录一次进入或离开，并把增量推送给其他订阅者
+// 进入时 user 已经加入 users，新用户自己收到的是完整列表而不是增量
+func (s *Server) rosterChanged(users map[*User]struct{}, user *User, joined bool) {
+	s.rosterSeq++
+	kind := KindRosterRemove
+	if joined {
+		kind = KindRosterAdd
+	}
+	diff := &Message{Kind: kind, From: user.NickName, RosterSeq: s.rosterSeq, Time: time.Now()}
+	for other := range users {
+		if other != user {
+			sendRoster(other, diff)
+		}
+	}
+	if joined {
+		sendRoster(user, s.rosterSnapshot(users))
+	}
+}
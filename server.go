@@ -2,15 +2,20 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
-	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/joho/godotenv"
 )
 
 type User struct {
@@ -18,7 +23,74 @@ type User struct {
 	NickName       string
 	Addr           string
 	EnterAt        time.Time
-	MessageChannel chan string
+	MessageChannel chan *Message
+	// 是否以 JSON 格式接收消息，读 goroutine 设置、写 goroutine 读取，所以使用 atomic
+	JSONMode atomic.Bool
+	// 消息分隔符，默认换行，可通过 /framing 切换；读写 goroutine 都会用到，所以使用 atomic
+	Delimiter atomic.Int32
+	// 是否以不带 ANSI 颜色的纯文本接收消息，默认跟随服务端的 COLOR 配置，可通过 /plain 切换
+	Plain atomic.Bool
+	// 是否为管理员，只在 broadcaster 中设置
+	IsAdmin atomic.Bool
+	// 是否屏蔽他人的进入、离开提醒，读 goroutine 通过 /quiet 切换、broadcaster 读取，所以使用 atomic
+	Quiet atomic.Bool
+
+	// 最近一条普通消息的内容和发送时间，用于消息去重
+	LastMessage   string
+	LastMessageAt time.Time
+
+	// 是否在版本握手中订阅了在线用户列表的增量推送，只在登记前写入
+	Roster bool
+	// 是否通过了按昵称区分凭证的认证（AUTH=file），只在登记前写入，为 true 时才保存个人设置
+	Authenticated bool
+
+	// JSON 握手时客户端附带的元数据，如客户端版本、平台、支持的能力，纯文本客户端为空
+	// 只在登记前写入，之后只读
+	Metadata map[string]string
+
+	// 断线重连令牌，由 broadcaster 在登记时签发
+	ResumeToken string
+	// 令牌是否交给过客户端（/token 或迁移通知），只有交出过令牌的会话才在断线后保留昵称
+	// 读 goroutine 写入、broadcaster 读取，所以使用 atomic
+	TokenShown atomic.Bool
+
+	// 最近一次输入的时间（UnixNano），读 goroutine 写入、broadcaster 读取，所以使用 atomic
+	LastActiveAt atomic.Int64
+	// 上一次使用 /welcome 的时间
+	LastWelcomeAt time.Time
+	// 上一条普通消息的发送时间，用于慢速模式
+	LastSentAt time.Time
+
+	// 离开状态及离开期间收到的私信，只在 broadcaster 中读写
+	Away            bool
+	AwayNote        string
+	PendingMessages []*Message
+
+	// 发送队列连续丢弃的条数、开始丢弃的时间，以及是否已因接收过慢或空闲被断开，只在 broadcaster 中读写
+	drops     int
+	dropSince time.Time
+	kicked    bool
+
+	// 用户所在的服务端
+	srv  *Server
+	conn net.Conn
+	// 写 goroutine 是否已切换为压缩输出
+	deflating atomic.Bool
+
+	// 连接的生命周期，连接断开时取消，用来中止该用户正在进行的 Gemini 请求
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// enterRequest 新用户登记，broadcaster 检查昵称是否可用后通过 Result 返回，空字符串表示登记成功
+// 检查和登记在 broadcaster 中一步完成，两个用户同时使用同一个昵称时只有一个能成功
+type enterRequest struct {
+	User *User
+	// 断线重连时客户端出示的令牌，为空表示新会话
+	Token string
+	// 认证通过后直接成为管理员
+	Admin  bool
+	Result chan string
 }
 
 // 定义一个 idCounter，用户保护 id 唯一
@@ -27,41 +99,272 @@ var (
 	idCounter sync.Mutex
 )
 
-var (
+// Server 聊天室服务端的全部共享状态：各个连接通过其中的 channel 把请求交给 broadcaster，
+// broadcaster 独占其余状态。每个 Server 互相独立，可以在同一进程中多次启动、关闭
+type Server struct {
 	// 新用户到来，通过该 channel 进行登记
-	enteringChannel = make(chan *User)
+	enteringChannel chan enterRequest
 	// 用户离开，通过该 channel 进行登记
-	leavingChannel = make(chan *User)
+	leavingChannel chan *User
 	// 广播专用的用户普通消息 channel，缓冲是尽可能避免出现异常情况堵塞，这里简单给了 8，具体值根据情况调整
-	messageChannel = make(chan string, 8)
-	geminiKey      string
-)
+	messageChannel chan *Message
+	// 读取最近的聊天记录，broadcaster 通过传入的 channel 返回一份拷贝
+	historyChannel chan chan []*Message
+	// 投票相关操作
+	pollChannel chan pollRequest
+	// 私信
+	privateChannel chan privateMessage
+	// 设置/取消离开状态
+	awayChannel chan awayRequest
+	// 用户通过管理员密码校验
+	adminChannel chan *User
+	// 用户举报
+	reportChannel chan *report
+	// 管理员开启/关闭维护模式
+	maintenanceChannel chan bool
+	// 管理员设置慢速模式的间隔，0 表示关闭
+	slowModeChannel chan time.Duration
+	// 管理员清空聊天记录
+	clearHistoryChannel chan *User
+	// 查询用户信息
+	whoisChannel chan whoisRequest
+	// 重新发送欢迎信息
+	welcomeChannel chan *User
+	// 管理员获取服务端状态快照
+	debugChannel chan chan *debugSnapshot
+	// JSON 模式下编辑、删除自己的消息
+	editChannel chan editRequest
+	// 查询、调整人数上限
+	capacityChannel chan capacityRequest
+	// 置顶、取消置顶
+	pinChannel chan pinRequest
+	// 镜像连接登记或离开
+	mirrorChannel chan mirrorRequest
+	// 添加、取消回应
+	reactChannel chan reactRequest
+	// 查询聊天室统计，broadcaster 直接回复给请求的用户
+	roomStatsChannel chan *User
+	// 读取最近的进出记录，broadcaster 通过传入的 channel 返回一份拷贝
+	sessionLogChannel chan chan []sessionEvent
+	// 请求完整的在线用户列表
+	rosterChannel chan *User
+	// 管理员发起迁移
+	migrateChannel chan migrateRequest
+	// 当前的 MOTD（每日消息），由 SIGHUP 重新加载或 /setmotd 设置后交给 broadcaster 替换
+	motdChannel chan string
+	// 重新加载的关键词规则，由 SIGHUP 触发，交给 broadcaster 替换
+	botRulesChannel chan []botRule
+
+	// 调用 shutdown 时关闭，broadcaster 随之通知所有在线用户并退出
+	shutdownChannel chan struct{}
+	// 保护 shutdownChannel 的关闭、activeConns 的登记和 pendingConns，关闭之后不会再有新的连接登记，waitConns 才不会漏等
+	connMutex sync.Mutex
+	// broadcaster 退出后关闭，之后不会再有人接收 enteringChannel、leavingChannel 等，
+	// 离开的连接据此放弃发送，避免永远阻塞
+	broadcasterDone chan struct{}
+	// 仍在处理的连接，关闭服务时等待它们退出，通过 trackConn 登记
+	activeConns sync.WaitGroup
+	// 已经接受、还没有进入聊天室的连接，关闭服务时让它们停在昵称或密码提示上的读操作返回
+	pendingConns map[net.Conn]struct{}
+
+	// 广播消息的序号，只在 broadcaster 中读写，因此序号的顺序就是实际广播的顺序。
+	// 使用 int64，即使每秒广播一百万条也要约 29 万年才会溢出，不考虑回绕
+	broadcastSeq int64
+	// 在线用户列表的版本号，只在 broadcaster 中读写
+	rosterSeq int64
+	// 只读镜像连接，接收聊天室的所有广播，供归档用的日志机器人使用
+	// 镜像连接不在 users 中，不出现在在线列表、统计和进出记录里，只在 broadcaster 中读写
+	mirrors map[*User]struct{}
+	// 慢速模式下非管理员两条消息之间的最小间隔（纳秒），0 表示关闭
+	// 只由 broadcaster 写入，各个读 goroutine 在发送消息前读取
+	slowModeInterval atomic.Int64
+	// 因接收过慢丢弃的消息总数和断开的连接数，只在 broadcaster 中读写
+	slowDrops, slowKicks int64
+	// 因输入速率超过 LINE_RATE_LIMIT 断开的连接数，由各个读 goroutine 累加
+	lineRateKicks atomic.Int64
+	// 服务端启动时间
+	startedAt time.Time
+}
+
+// newServer 创建一个尚未启动的 Server，之后启动 broadcaster 并把 listener 交给 serve
+func newServer() *Server {
+	return &Server{
+		enteringChannel:     make(chan enterRequest),
+		leavingChannel:      make(chan *User),
+		messageChannel:      make(chan *Message, 8),
+		historyChannel:      make(chan chan []*Message),
+		pollChannel:         make(chan pollRequest),
+		privateChannel:      make(chan privateMessage),
+		awayChannel:         make(chan awayRequest),
+		adminChannel:        make(chan *User),
+		reportChannel:       make(chan *report),
+		maintenanceChannel:  make(chan bool),
+		slowModeChannel:     make(chan time.Duration),
+		clearHistoryChannel: make(chan *User),
+		whoisChannel:        make(chan whoisRequest),
+		welcomeChannel:      make(chan *User),
+		debugChannel:        make(chan chan *debugSnapshot),
+		editChannel:         make(chan editRequest),
+		capacityChannel:     make(chan capacityRequest),
+		pinChannel:          make(chan pinRequest),
+		mirrorChannel:       make(chan mirrorRequest),
+		reactChannel:        make(chan reactRequest),
+		roomStatsChannel:    make(chan *User),
+		sessionLogChannel:   make(chan chan []sessionEvent),
+		rosterChannel:       make(chan *User),
+		migrateChannel:      make(chan migrateRequest),
+		motdChannel:         make(chan string),
+		botRulesChannel:     make(chan []botRule),
+		shutdownChannel:     make(chan struct{}),
+		broadcasterDone:     make(chan struct{}),
+		pendingConns:        make(map[net.Conn]struct{}),
+		mirrors:             make(map[*User]struct{}),
+		startedAt:           time.Now(),
+	}
+}
 
 func main() {
+	// 从本地读取环境变量
+	loadEnvFile()
+	loadConfig()
+	logConfig()
+
 	// 不填 IP 就会绑定到当前机器所有的 IP 上
 	// 0.0.0.0 同一个网络内任意 PC 都可访问
-	listener, err := net.Listen("tcp", "0.0.0.0:2020")
+	listener, err := listenTCP("0.0.0.0:2020", listenBacklog)
 	if err != nil {
 		panic(err)
 	}
 
-	// 从本地读取环境变量
-	godotenv.Load()
+	if err := parseTemplates(); err != nil {
+		log.Fatalln(err)
+	}
+	if authenticator, err = newAuthenticator(authMode, authPassword, authFilePath); err != nil {
+		log.Fatalln("初始化认证失败：", err)
+	}
+
+	if prefsPath != "" {
+		if err := loadPrefs(prefsPath); err != nil {
+			log.Fatalln("读取个人设置失败：", err)
+		}
+	}
+
+	if auditLogPath != "" {
+		if err := startAudit(auditLogPath); err != nil {
+			log.Fatalln("打开审计日志失败：", err)
+		}
+	}
 
-	geminiKey = os.Getenv("GEMINI_PRO_API_KEY")
+	srv := newServer()
+	if wsListenAddr != "" {
+		go srv.serveWebSocket(wsListenAddr)
+	}
+
+	go watchReload(srv)
+	if reconnectLimit > 0 {
+		go cleanupReconnects()
+	}
 
 	log.Println("服务已启动！")
 
-	go broadcaster()
+	go watchShutdown(srv, listener)
+	go srv.broadcaster()
+
+	srv.serve(listener)
+
+	// 监听已关闭，等在线用户的连接处理完离开流程后再退出
+	if !srv.waitConns(shutdownTimeout) {
+		warnf("等待连接退出超时，强制关闭")
+	}
+	// 最后写完缓冲中的审计事件
+	stopAudit()
+	infof("服务已关闭")
+}
+
+// 接受连接出错后的重试间隔，从 acceptBackoffMin 开始每次翻倍，最多 acceptBackoffMax
+const (
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+)
 
+// serve 循环接受新连接，任何 net.Listener 都可以接入（包括内存中的实现，便于不经过真实网络驱动整个流程）
+// 监听被关闭时返回；其他错误（如文件描述符耗尽）多半是暂时的，记录日志后退避重试，不让整个服务退出
+func (s *Server) serve(listener net.Listener) {
+	var backoff time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Panicln(err)
+			if s.shuttingDown() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if backoff == 0 {
+				backoff = acceptBackoffMin
+			} else {
+				backoff = min(backoff*2, acceptBackoffMax)
+			}
+			errorf("接受连接失败：%v，%v 后重试", err, backoff)
+			time.Sleep(backoff)
 			continue
 		}
+		backoff = 0
+
+		setKeepAlive(conn)
+		go s.serveConn(conn)
+	}
+}
 
-		go handleConn(conn)
+// serveConn 对新连接做准入检查后交给 handleConn，TCP 和 WebSocket 连接共用
+func (s *Server) serveConn(conn net.Conn) {
+	if !s.trackConn(conn) {
+		conn.Close()
+		return
+	}
+	defer s.untrackConn(conn)
+
+	ip := remoteIP(conn.RemoteAddr())
+	if reason := checkCIDR(ip); reason != "" {
+		infof("拒绝连接：%s", reason)
+		audit(conn.RemoteAddr().String(), "reject", reason)
+		conn.Close()
+		return
+	}
+	if !allowReconnect(ip, time.Now()) {
+		audit(conn.RemoteAddr().String(), "reject", "重连过于频繁")
+		fmt.Fprintln(conn, "重连过于频繁，请稍后")
+		conn.Close()
+		return
+	}
+	if !acquireConn(ip) {
+		infof("拒绝连接：%s 连接数超过上限", ip)
+		audit(conn.RemoteAddr().String(), "reject", "连接数超过上限")
+		fmt.Fprintln(conn, "来自你 IP 的连接过多")
+		conn.Close()
+		return
+	}
+	// 无论连接以何种方式断开，都要归还名额
+	defer releaseConn(ip)
+
+	audit(conn.RemoteAddr().String(), "connect", "")
+	s.handleConn(conn)
+}
+
+// setKeepAlive 为 TCP 连接开启系统层面的 keep-alive，让内核及时回收已经断开的对端
+// 非 TCP 连接（如 unix socket）直接跳过
+func setKeepAlive(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if keepAlivePeriod <= 0 {
+		tcpConn.SetKeepAlive(false)
+		return
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		warnf("开启 keep-alive 失败：%v", err)
+		return
+	}
+	if err := tcpConn.SetKeepAlivePeriod(keepAlivePeriod); err != nil {
+		warnf("设置 keep-alive 间隔失败：%v", err)
 	}
 }
 
@@ -70,30 +373,277 @@ func main() {
 // 这里关键有 3 点：
 // 负责登记/注销用户，通过 map 存储在线用户；
 // 用户登记、注销，使用专门的 channel。在注销时，除了从 map 中删除用户，还将 user 的 MessageChannel 关闭，避免上文提到的 goroutine 泄露问题；
-// 全局的 messageChannel 用来给聊天室所有用户广播消息；
-func broadcaster() {
+// Server 的 messageChannel 用来给聊天室所有用户广播消息；
+func (s *Server) broadcaster() {
 	users := make(map[*User]struct{})
+	// 最近的聊天消息，最多保留 historySize 条
+	var history []*Message
+	// 当前进行中的投票
+	var activePoll *poll
+	// 没有管理员在线时暂存的举报
+	var pendingReports []*report
+	// 断线重连的会话
+	resumed := make(sessions)
+	// 最近的进出记录
+	var sessionLog []sessionEvent
+	// 最近消息收到的回应
+	reacts := make(reactions)
+	// 消息总数、最高在线人数等累计数据
+	var stats roomStats
+	// 每日消息，进入聊天室时显示
+	var motd string
+	if motdPath != "" {
+		var err error
+		if motd, err = loadMOTD(motdPath); err != nil {
+			warnf("加载 MOTD 失败：%v", err)
+		}
+	}
+	// 人数上限，0 表示不限制，管理员可以通过 /capacity 调整
+	capacity := maxUsers
+	// 管理员置顶的内容，新用户进入时显示
+	var pinned string
+	// 维护模式下只转发管理员的消息
+	maintenance := false
+	// 关键词自动回复机器人，未开启时为 nil
+	var bot *greetingBot
+	if botEnabled {
+		rules, err := loadBotRules(botRulesPath)
+		if err != nil {
+			warnf("加载机器人关键词失败：%v", err)
+		}
+		bot = &greetingBot{rules: rules}
+	}
+	// 迁移的目标地址和断开所有连接的定时器，没有迁移时为空
+	var migrateAddr string
+	var migrateTimer <-chan time.Time
+	idle := idleTicker()
+	defer close(s.broadcasterDone)
 
 	for {
 		select {
-		case user := <-enteringChannel:
+		case req := <-s.enteringChannel:
 			// 新用户进入
+			user := req.User
+			resumed.expire(time.Now())
+			if req.Token != "" {
+				nick, ok := resumed.lookup(req.Token)
+				if !ok {
+					req.Result <- "重连令牌无效或已过期"
+					continue
+				}
+				user.NickName = nick
+			}
+			if migrateAddr != "" {
+				req.Result <- "服务器已迁移到 " + migrateAddr
+				continue
+			}
+			if findUser(users, user.NickName) != nil {
+				req.Result <- "昵称 " + user.NickName + " 已被使用"
+				continue
+			}
+			// 凭令牌重连时保留的正是这个人自己的会话
+			if req.Token == "" && resumed.reserved(user.NickName) {
+				if !user.Authenticated {
+					req.Result <- "昵称 " + user.NickName + " 正保留给断线重连的用户"
+					continue
+				}
+				// 通过认证的昵称主人直接收回昵称，之前的令牌随之作废
+				resumed.release(user.NickName)
+			}
+			if roomFull(users, capacity) {
+				req.Result <- "聊天室已满（上限 " + strconv.Itoa(capacity) + " 人），请稍后再试"
+				continue
+			}
+			// 所有检查都通过后才作废旧令牌
+			if req.Token != "" {
+				resumed.consume(req.Token)
+			}
+			if resumeTTL > 0 {
+				resumed.issue(user)
+			}
+			// 先给其他人发送提醒再登记，避免自己收到自己到来的消息
+			s.broadcast(users, newPresence(renderNotice(joinTemplate, user)))
+			sendWelcome(user, motd, pinned)
 			users[user] = struct{}{}
-		case user := <-leavingChannel:
+			stats.Peak = max(stats.Peak, len(users))
+			s.rosterChanged(users, user, true)
+			sessionLog = appendSessionLog(sessionLog, user.NickName, true)
+			if req.Admin {
+				handleAdmin(user, &pendingReports)
+			}
+			req.Result <- ""
+		case user := <-s.leavingChannel:
 			// 用户离开
 			delete(users, user)
+			s.closePollOf(&activePoll, user, users)
+			s.rosterChanged(users, user, false)
+			sessionLog = appendSessionLog(sessionLog, user.NickName, false)
+			now := time.Now()
+			resumed.expire(now)
+			resumed.detach(user, now)
 			// 避免 goroutine 泄露
 			close(user.MessageChannel)
-		case msg := <-messageChannel:
-			// 给所有在线用户发送消息
-			for user := range users {
-				user.MessageChannel <- msg
+		case msg := <-s.messageChannel:
+			if maintenance && msg.sender != nil && !msg.sender.IsAdmin.Load() {
+				// messageChannel 有缓冲，发送者可能已经离开，只在其仍在线时回复
+				if _, ok := users[msg.sender]; ok {
+					msg.sender.tell("服务器维护中，消息未发送")
+				}
+				continue
+			}
+			if msg.ReplyTo != 0 {
+				resolveReply(users, history, msg)
+			}
+			if msg.From != "" {
+				history = appendHistory(history, msg)
+				stats.Messages++
+			}
+			s.broadcast(users, msg)
+			if bot != nil {
+				if reply := bot.reply(msg); reply != nil {
+					history = appendHistory(history, reply)
+					s.broadcast(users, reply)
+				}
 			}
+		case on := <-s.maintenanceChannel:
+			if on == maintenance {
+				continue
+			}
+			maintenance = on
+			if on {
+				s.broadcast(users, newMessage("", "🔧 服务器进入维护模式，暂停转发普通消息"))
+			} else {
+				s.broadcast(users, newMessage("", "✅ 维护结束，恢复正常聊天"))
+			}
+		case interval := <-s.slowModeChannel:
+			s.slowModeInterval.Store(int64(interval))
+			if interval > 0 {
+				s.broadcast(users, newMessage("", "🐢 已开启慢速模式：每 "+interval.String()+" 只能发送一条消息"))
+			} else {
+				s.broadcast(users, newMessage("", "已关闭慢速模式"))
+			}
+		case user := <-s.clearHistoryChannel:
+			// 之前通过 historyChannel 取走的都是拷贝，这里直接丢弃即可
+			history = nil
+			s.broadcast(users, newMessage("", "聊天记录已清空（操作人："+user.NickName+"）"))
+		case user := <-s.welcomeChannel:
+			sendWelcome(user, motd, pinned)
+		case motd = <-s.motdChannel:
+		case reply := <-s.debugChannel:
+			reply <- &debugSnapshot{
+				Time:        time.Now(),
+				Users:       len(users),
+				UserList:    snapshotUsers(users),
+				History:     len(history),
+				Maintenance: maintenance,
+				SlowMode:    time.Duration(s.slowModeInterval.Load()).String(),
+				ActivePoll:  activePoll != nil,
+				Reports:     len(pendingReports),
+				Limits: debugLimits{
+					SlowDrops:     s.slowDrops,
+					SlowKicks:     s.slowKicks,
+					LineRateKicks: s.lineRateKicks.Load(),
+				},
+			}
+		case <-s.shutdownChannel:
+			s.handleShutdown(users)
+			return
+		case now := <-idle:
+			kickIdle(users, now)
+		case user := <-s.rosterChannel:
+			user.deliver(s.rosterSnapshot(users))
+		case req := <-s.migrateChannel:
+			migrateAddr, migrateTimer = s.handleMigrate(users, migrateAddr, migrateTimer, req)
+		case <-migrateTimer:
+			migrateTimer = nil
+			s.finishMigrate(users, migrateAddr)
+		case req := <-s.capacityChannel:
+			capacity = handleCapacity(users, capacity, req)
+		case req := <-s.pinChannel:
+			pinned = s.handlePin(users, history, pinned, req)
+		case req := <-s.mirrorChannel:
+			s.handleMirror(req)
+		case req := <-s.reactChannel:
+			s.handleReact(users, history, reacts, req)
+		case req := <-s.editChannel:
+			if maintenance && !req.Delete && !req.User.IsAdmin.Load() {
+				req.User.tell("服务器维护中，编辑未发送")
+				continue
+			}
+			history = s.handleEdit(users, history, req)
+		case req := <-s.whoisChannel:
+			handleWhois(users, req)
+		case rules := <-s.botRulesChannel:
+			if bot != nil {
+				bot.rules = rules
+			}
+		case reply := <-s.historyChannel:
+			reply <- append([]*Message(nil), history...)
+		case user := <-s.roomStatsChannel:
+			s.handleRoomStats(users, stats, user)
+		case reply := <-s.sessionLogChannel:
+			reply <- append([]sessionEvent(nil), sessionLog...)
+		case req := <-s.pollChannel:
+			if maintenance && req.Action == pollOpen && !req.User.IsAdmin.Load() {
+				req.User.tell("服务器维护中，无法发起投票")
+				continue
+			}
+			s.handlePoll(&activePoll, req, users)
+		case pm := <-s.privateChannel:
+			handlePrivate(users, pm)
+		case req := <-s.awayChannel:
+			handleAway(req)
+		case user := <-s.adminChannel:
+			handleAdmin(user, &pendingReports)
+		case r := <-s.reportChannel:
+			handleReport(users, r, &pendingReports)
+		}
+	}
+}
+
+// appendHistory 记录一条聊天消息，超出 historySize 时丢弃最早的
+func appendHistory(history []*Message, msg *Message) []*Message {
+	history = append(history, msg)
+	if len(history) > historySize {
+		history = history[len(history)-historySize:]
+	}
+	return history
+}
+
+// broadcast 为消息分配序号后发给所有在线用户，只能在 broadcaster 中调用
+// 进入、离开提醒不会发给开启了 /quiet 的用户，因此不分配序号，否则这些用户会看到序号不连续，误以为漏收了消息
+// 消息发出后会被多个写 goroutine 同时读取，不能再修改
+func (s *Server) broadcast(users map[*User]struct{}, msg *Message) {
+	if !msg.presence {
+		s.broadcastSeq++
+		msg.Seq = s.broadcastSeq
+	}
+	// 前后缀与接收者无关，在这里生成一次，写 goroutine 直接使用
+	msg.linePrefix = renderLine(linePrefixTemplate, msg)
+	msg.lineSuffix = renderLine(lineSuffixTemplate, msg)
+	for user := range users {
+		if msg.presence && user.Quiet.Load() {
+			continue
 		}
+		user.deliver(msg)
+	}
+	for mirror := range s.mirrors {
+		mirror.deliver(msg)
 	}
 }
 
-func handleConn(conn net.Conn) {
+// lastActive 返回用户最近一次输入的时间
+func (u *User) lastActive() time.Time {
+	return time.Unix(0, u.LastActiveAt.Load())
+}
+
+// notify 给用户发送一条只有该用户能看到的提示，发送队列满时阻塞，只能在该用户的读 goroutine 中调用，
+// 否则一个不读数据的客户端就能拖住调用方；broadcaster 中使用 tell
+func (u *User) notify(text string) {
+	u.MessageChannel <- newNotice(text)
+}
+
+func (s *Server) handleConn(conn net.Conn) {
 	defer conn.Close()
 
 	// 1. 新用户进来，构建该用户的实例
@@ -101,47 +651,237 @@ func handleConn(conn net.Conn) {
 		ID:             genUserID(),
 		Addr:           conn.RemoteAddr().String(),
 		EnterAt:        time.Now(),
-		MessageChannel: make(chan string, 8),
+		MessageChannel: make(chan *Message, 8),
+		srv:            s,
+		conn:           conn,
 	}
+	user.ctx, user.cancel = context.WithCancel(context.Background())
+	defer user.cancel()
+	user.LastActiveAt.Store(user.EnterAt.UnixNano())
+	user.Delimiter.Store(int32(delimNewline))
+	user.Plain.Store(!colorEnabled)
 
 	// 2. 当前在一个新的 goroutine 中，用来进行读操作，因此需要开一个 goroutine 用于写操作
 	// 读写 goroutine 之间可以通过 channel 进行通信
-	go sendMessage(conn, user.MessageChannel)
-
-	// 3. 给当前用户发送欢迎信息
-	// 同时给聊天室所有用户发送有新用户到来的提醒；
-	user.MessageChannel <- "请输入你的昵称："
-	nickName := bufio.NewScanner(conn)
-	if nickName.Scan() {
-		user.NickName = nickName.Text()
-		user.MessageChannel <- "欢迎你的到来：" + user.NickName
-		messageChannel <- "user:`" + user.NickName + "` has enter"
-	} else {
-		return
+	writerDone := make(chan struct{})
+	go func() {
+		sendMessage(conn, user)
+		close(writerDone)
+	}()
+	// 登记之前断开时，用户不在 broadcaster 的列表中，不会经过 leavingChannel，
+	// 需要由这里关闭 MessageChannel，并等写 goroutine 把剩余的提示发完后退出，避免 goroutine 泄露
+	abort := func() {
+		close(user.MessageChannel)
+		// 对端不再读取时写操作可能一直阻塞，最多再等 1 秒
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		<-writerDone
 	}
 
-	// 4. 将该记录到全局的用户列表中，避免用锁
-	// 注意，这里和 3）的顺序不能反，否则自己会收到自己到来的消息提醒；（当然，我们也可以做消息过滤处理）
-	enteringChannel <- user
-
-	// 5. 循环读取用户的输入
+	// 3. 读取昵称，并将用户记录到全局的用户列表中，避免用锁
+	// 登记成功后 broadcaster 会给当前用户发送欢迎信息，同时给聊天室所有用户发送有新用户到来的提醒；
+	user.notify("请输入你的昵称：")
+	// 昵称和后续消息共用同一个 Scanner，避免第一个 Scanner 预读的数据丢失
 	input := bufio.NewScanner(conn)
-	for input.Scan() {
-		if strings.HasPrefix(input.Text(), "gemini:") {
-			rep := GeminiChatComplete(input.Text())
-			user.MessageChannel <- rep
-		} else {
-			messageChannel <- user.NickName + ": " + input.Text()
+	input.Split(user.splitFunc())
+	// WebSocket 按文本帧收发，不能压缩
+	_, isWS := conn.(*wsConn)
+	// 是否已经协商过协议选项，hello 只发送一次
+	negotiated := false
+	first := true
+	// next 读取下一行输入，连接断开、连错协议或者收到无法识别的数据时关闭连接并返回 false
+	next := func() (string, bool) {
+		if !input.Scan() {
+			if err := input.Err(); err != nil {
+				infof("连接在进入聊天室前断开：%s %v", user.Addr, err)
+			} else {
+				infof("连接在进入聊天室前断开：%s", user.Addr)
+			}
+			abort()
+			return "", false
+		}
+		if first {
+			first = false
+			if reason := wrongProtocol(input.Text(), isWS); reason != "" {
+				// 给出一行说明再断开，方便排查对接问题
+				infof("客户端协议不匹配，断开连接：%s %s", user.Addr, reason)
+				user.notify(reason)
+				abort()
+				return "", false
+			}
+		}
+		if isGarbage(input.Text()) {
+			// 多半是端口扫描或者连错了服务的客户端，直接断开
+			infof("收到无法识别的数据，断开连接：%s", user.Addr)
+			abort()
+			return "", false
+		}
+		return input.Text(), true
+	}
+	for attempts := 1; ; attempts++ {
+		line, ok := next()
+		if !ok {
+			return
+		}
+
+		parsed := parseNickLine(user, line)
+		if parsed.Version > 0 && !negotiated {
+			negotiated = true
+			if negotiate(user, parsed.Features, !isWS) {
+				// 客户端收到 hello 之后才会发送压缩数据，原 Scanner 中没有预读的内容
+				input = bufio.NewScanner(flate.NewReader(conn))
+				input.Split(user.splitFunc())
+			}
+		}
+		nickName, token, reason := parsed.Nick, parsed.Token, parsed.Reason
+		if parsed.Mirror != "" {
+			if checkMirrorToken(parsed.Mirror) {
+				serveMirror(user, input, abort)
+				return
+			}
+			audit(user.Addr, "auth-failed", "mirror")
+			reason = "镜像令牌错误"
+		}
+		nickName, _ = truncateDisplay(nickName, maxNickWidth)
+		if reason == "" && token == "" {
+			reason = validateNick(nickName)
+		}
+		admin := false
+		if reason == "" && token == "" && authenticator.NeedsCredential() {
+			// JSON 握手可以直接带上凭证，否则单独提示输入
+			credential := parsed.Credential
+			if credential == "" {
+				user.notify("请输入密码：")
+				if credential, ok = next(); !ok {
+					return
+				}
+			}
+			var allowed bool
+			if allowed, admin = authenticator.Authenticate(nickName, credential); !allowed {
+				audit(user.Addr, "auth-failed", nickName)
+				reason = "认证失败"
+			}
+			user.Authenticated = allowed && authenticator.PerNick()
+		}
+		if reason == "" {
+			// 使用令牌重连时，昵称由 broadcaster 根据会话设置
+			user.NickName = nickName
+			restorePrefs(user)
+			result := make(chan string)
+			if !submit(s, s.enteringChannel, enterRequest{User: user, Token: token, Admin: admin, Result: result}) {
+				user.notify("服务器正在关闭")
+				abort()
+				return
+			}
+			reason = <-result
+		}
+		if reason == "" {
+			s.admitConn(conn)
+			break
+		}
+
+		if maxNickAttempts > 0 && attempts >= maxNickAttempts {
+			user.notify("尝试次数过多，连接关闭")
+			abort()
+			return
 		}
+		user.notify(reason + "，请重新输入：")
+	}
+	audit(user.Addr, "nick", user.NickName)
+	if user.IsAdmin.Load() {
+		audit(user.Addr, "admin", user.NickName)
 	}
 
-	if err := input.Err(); err != nil {
-		log.Println("读取错误：", err)
+	// 5. 循环读取用户的输入
+	// 读取放在单独的 goroutine 中：处理某一行时（如等待 Gemini 回复）对端断开，也能立即发现并取消 ctx，
+	// 中止进行中的请求；处理完这一行之前不再交出新的输入，所以仍然只有当前 goroutine 处理输入
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		defer user.cancel()
+		for input.Scan() {
+			select {
+			case lines <- input.Text():
+			case <-user.ctx.Done():
+				return
+			}
+		}
+		// 关闭服务时读操作会因为超时返回，不算错误
+		if err := input.Err(); err != nil && !s.shuttingDown() {
+			warnf("读取错误：%v", err)
+		}
+	}()
+	var rate lineRate
+	for line := range lines {
+		if !rate.allow(time.Now()) {
+			// 只断开这一次连接，不做封禁，客户端恢复正常后可以重新连接
+			warnf("输入速率超过上限，断开连接：%s %s", user.Addr, user.NickName)
+			s.lineRateKicks.Add(1)
+			audit(user.Addr, "flood-disconnect", user.NickName)
+			user.disconnect("检测到异常流量，连接已断开")
+			break
+		}
+		handleInput(user, line)
+	}
+	// 断开连接后读取的 goroutine 随之退出，等它结束再离开
+	for range lines {
 	}
 
 	// 6. 用户离开
-	leavingChannel <- user
-	messageChannel <- "user:`" + user.NickName + "` has left"
+	user.leave(abort)
+}
+
+// leave 用户离开：通知 broadcaster 移除用户并广播离开提醒，abort 用于 broadcaster 已经退出时自行关闭 MessageChannel
+// 离开流程只在 handleConn 的末尾、由读 goroutine 执行这一次，不需要额外的 sync.Once：
+// 写 goroutine 写失败、慢速断开、空闲断开、关闭服务等其他发现连接断开的一方都只关闭连接或设置读超时，
+// 让读 goroutine 从读错误中退出后再走到这里，因此不会重复广播离开提醒、重复关闭 MessageChannel
+func (u *User) leave(abort func()) {
+	audit(u.Addr, "disconnect", u.NickName)
+	if !submit(u.srv, u.srv.leavingChannel, u) {
+		// broadcaster 已经退出，不会再关闭 MessageChannel，由这里关闭并等写 goroutine 把剩余的提示发完
+		abort()
+		return
+	}
+	submit(u.srv, u.srv.messageChannel, newPresence(renderNotice(leaveTemplate, u)))
+}
+
+// validateNick 检查昵称格式，合法时返回空字符串，否则返回原因
+func validateNick(nickName string) string {
+	switch {
+	case nickName == "":
+		return "昵称不能为空"
+	case strings.ContainsAny(nickName, " \t"):
+		return "昵称不能包含空格"
+	case hasControl(nickName):
+		return "昵称不能包含控制字符"
+	case strings.HasPrefix(nickName, "/"):
+		return "昵称不能以 / 开头"
+	case botEnabled && nickName == botName:
+		return "昵称 " + nickName + " 已被机器人使用"
+	}
+	return ""
+}
+
+// isDuplicate 判断该消息是否为短时间内的重复发送，同时记录本次消息
+// 未开启去重时总是返回 false
+func isDuplicate(user *User, msg string) bool {
+	if !dedupEnabled {
+		return false
+	}
+
+	now := time.Now()
+	dup := msg == user.LastMessage && now.Sub(user.LastMessageAt) < dedupWindow
+	user.LastMessage = msg
+	user.LastMessageAt = now
+	return dup
+}
+
+// recentHistory 返回最近的聊天消息，按时间从旧到新排列
+func (s *Server) recentHistory() []*Message {
+	reply := make(chan []*Message)
+	if !submit(s, s.historyChannel, reply) {
+		return nil
+	}
+	return <-reply
 }
 
 func genUserID() int {
@@ -155,9 +895,53 @@ func genUserID() int {
 // channel 实际上有三种类型，大部分时候，我们只用了其中一种，就是正常的既能发送也能接收的 channel。
 // 除此之外还有单向的 channel：只能接收（<-chan，only receive）和只能发送（chan<-， only send）。
 // 它们没法直接创建，而是通过正常（双向）channel 转换而来（会自动隐式转换）。
-// 它们存在的价值，主要是避免 channel 被乱用。上面代码中 ch <-chan string 就是为了限制在 sendMessage 函数中只从 channel 读数据，不允许往里写数据。
-func sendMessage(conn net.Conn, ch <-chan string) {
+// 它们存在的价值，主要是避免 channel 被乱用。这里 ch <-chan *Message 就是为了限制在 sendMessage 函数中只从 channel 读数据，不允许往里写数据。
+func sendMessage(conn net.Conn, user *User) {
+	var ch <-chan *Message = user.MessageChannel
+	var buf bytes.Buffer
+	// 协商了 deflate 之后改为写入压缩流
+	var out io.Writer = conn
+	var fw *flate.Writer
+	// 写失败后不再写入，只把剩余的消息取完，直到 MessageChannel 关闭
+	failed := false
 	for msg := range ch {
-		fmt.Fprintln(conn, msg)
+		if failed {
+			continue
+		}
+		buf.Reset()
+		encodeMessage(&buf, user, msg)
+		_, err := out.Write(buf.Bytes())
+		if err == nil && fw != nil {
+			err = fw.Flush()
+		}
+		if err != nil {
+			// 对端已经断开，关闭连接让读 goroutine 尽快返回并走离开流程
+			failed = true
+			user.cancel()
+			conn.Close()
+			continue
+		}
+		if msg.startDeflate && fw == nil {
+			fw, _ = flate.NewWriter(conn, flate.BestSpeed)
+			out = fw
+			user.deflating.Store(true)
+		}
+	}
+	if fw != nil {
+		fw.Close()
+	}
+}
+
+// encodeMessage 按用户当前的模式把消息编码后追加到 buf，末尾加上分隔符
+func encodeMessage(buf *bytes.Buffer, user *User, msg *Message) {
+	if user.JSONMode.Load() || msg.Kind == KindHello {
+		encoder := json.NewEncoder(buf)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(msg)
+		// Encode 会在末尾追加换行，统一换成当前连接的分隔符
+		buf.Truncate(buf.Len() - 1)
+	} else {
+		buf.WriteString(msg.Text(user.Plain.Load()))
 	}
+	buf.WriteByte(user.delimiter())
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestBroadcastFanOut(t *testing.T) {
+	ts := startServer(t)
+	alice := ts.join("alice")
+	bob := ts.join("bob")
+	carol := ts.join("carol")
+	alice.expect("carol` has enter")
+	bob.expect("carol` has enter")
+
+	alice.send("hello")
+	for _, c := range []*testClient{alice, bob, carol} {
+		if line := c.expect("hello"); line != "alice: hello" {
+			t.Errorf("收到 %q，期望 %q", line, "alice: hello")
+		}
+	}
+}
+
+func TestLeaveBroadcastOnce(t *testing.T) {
+	ts := startServer(t)
+	alice := ts.join("alice")
+	bob := ts.join("bob")
+	alice.expect("bob` has enter")
+
+	bob.close()
+	alice.expect("bob` has left")
+	for _, line := range alice.collect(200 * time.Millisecond) {
+		if strings.Contains(line, "has left") {
+			t.Errorf("离开提醒重复出现：%q", line)
+		}
+	}
+}
+
+func TestConcurrentCloseLeavesOnce(t *testing.T) {
+	verifyNoLeak(t)
+	ts := startServer(t)
+	alice := ts.join("alice")
+
+	for i := 0; i < 20; i++ {
+		nick := "bob" + strconv.Itoa(i)
+		// 自己建立连接，以便拿到服务端一端：关闭它相当于写 goroutine 写失败或被踢时关闭连接
+		client, server := net.Pipe()
+		ts.listener.conns <- server
+		bob := newTestClient(t, client)
+		bob.expect("请输入你的昵称")
+		bob.send(nick)
+		bob.expect("欢迎你的到来")
+		alice.expect(nick + "` has enter")
+
+		// alice 刚发出一条消息，bob 的写 goroutine 可能正在写入，这时两端同时关闭
+		alice.send("ping " + nick)
+		done := make(chan struct{})
+		go func() {
+			server.Close()
+			close(done)
+		}()
+		bob.close()
+		<-done
+
+		alice.expect(nick + "` has left")
+	}
+	alice.collect(200 * time.Millisecond)
+	left := 0
+	for _, line := range alice.received {
+		if strings.Contains(line, "has left") {
+			left++
+		}
+	}
+	if left != 20 {
+		t.Errorf("收到 %d 条离开提醒，期望 20 条", left)
+	}
+}
+
+func TestSlowClientDisconnected(t *testing.T) {
+	setConfig(t, &slowClientMaxDrops, 5)
+	ts := startServer(t)
+	alice := ts.join("alice")
+
+	// slow 进入聊天室后不再读取，服务端的写操作会一直阻塞
+	conn := ts.listener.dial(t, "")
+	defer conn.Close()
+	input := bufio.NewReader(conn)
+	readUntil(t, conn, input, "请输入你的昵称")
+	conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	io.WriteString(conn, "slow\n")
+	readUntil(t, conn, input, "欢迎你的到来")
+	alice.expect("slow` has enter")
+
+	// 每条都等自己收到后再发下一条，alice 自己的发送队列不会积压
+	for i := 0; i < 30; i++ {
+		alice.send("msg " + strconv.Itoa(i))
+		alice.expect("msg " + strconv.Itoa(i))
+	}
+	// 其他人不受影响，slow 被断开后广播离开提醒
+	alice.expect("slow` has left")
+}
+
+func TestNonReadingClientCannotStallRoom(t *testing.T) {
+	setConfig(t, &lineRateLimit, 0)
+	setConfig(t, &slowClientMaxDrops, 5)
+	ts := startServer(t)
+	alice := ts.join("alice")
+
+	conn := ts.listener.dial(t, "")
+	defer conn.Close()
+	input := bufio.NewReader(conn)
+	readUntil(t, conn, input, "请输入你的昵称")
+	conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	io.WriteString(conn, "mallory\n")
+	readUntil(t, conn, input, "欢迎你的到来")
+
+	// mallory 不停查询却从不读取，broadcaster 的回复只能进入发送队列，不能拖住聊天室
+	go func() {
+		for {
+			if _, err := io.WriteString(conn, "/whois alice\n"); err != nil {
+				return
+			}
+		}
+	}()
+	alice.expect("mallory` has left")
+	alice.send("still responsive")
+	alice.expect("alice: still responsive")
+	ts.join("bob")
+}
+
+// flakyListener 在真正的 Accept 之前先返回若干次暂时性错误，模拟文件描述符耗尽
+type flakyListener struct {
+	net.Listener
+	mu       sync.Mutex
+	failures int
+}
+
+func (l *flakyListener) fail(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failures += n
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.failures > 0 {
+		l.failures--
+		l.mu.Unlock()
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: errors.New("too many open files")}
+	}
+	l.mu.Unlock()
+	return l.Listener.Accept()
+}
+
+func TestServeSurvivesAcceptErrors(t *testing.T) {
+	var flaky *flakyListener
+	ts := startServerOn(t, func(l net.Listener) net.Listener {
+		flaky = &flakyListener{Listener: l, failures: 5}
+		return flaky
+	})
+
+	// 连续出错后退避重试，之后的连接照常接受
+	alice := ts.join("alice")
+	flaky.fail(3)
+	ts.join("bob")
+	alice.expect("bob` has enter")
+
+	select {
+	case <-ts.served:
+		t.Fatal("暂时性错误导致 accept 循环退出")
+	default:
+	}
+
+	// listener 关闭是永久性错误，accept 循环随即退出
+	ts.stop()
+	select {
+	case <-ts.served:
+	default:
+		t.Error("listener 关闭后 accept 循环没有退出")
+	}
+}
+
+// readUntil 在不经过 testClient 的原始连接上读取，直到出现 substr
+func readUntil(t *testing.T, conn net.Conn, input *bufio.Reader, substr string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		line, err := input.ReadString('\n')
+		if err != nil {
+			t.Fatalf("等待 %q 时读取失败：%v", substr, err)
+		}
+		if strings.Contains(line, substr) {
+			return
+		}
+	}
+}
+
+func TestNickAttemptsExhausted(t *testing.T) {
+	setConfig(t, &maxNickAttempts, 3)
+	ts := startServer(t)
+	ts.join("alice")
+
+	c := ts.connect("")
+	c.expect("请输入你的昵称")
+	// 格式错误和昵称重复都算一次尝试
+	c.send("a b")
+	c.expect("昵称不能包含空格，请重新输入")
+	c.send("alice")
+	c.expect("已被使用，请重新输入")
+	c.send("/root")
+	lines := c.expectClosed()
+	if len(lines) == 0 || lines[len(lines)-1] != "尝试次数过多，连接关闭" {
+		t.Errorf("用完尝试次数后收到 %q", lines)
+	}
+	for _, line := range lines {
+		if strings.Contains(line, "请重新输入") {
+			t.Errorf("最后一次尝试失败后仍提示重新输入：%q", line)
+		}
+	}
+}
+
+func TestBroadcastPrefixEveryLine(t *testing.T) {
+	setConfig(t, &linePrefixTemplate, template.Must(template.New("BROADCAST_PREFIX").Parse("[{{.Seq}}] ")))
+	ts := startServer(t)
+	alice := ts.join("alice")
+	bob := ts.join("bob")
+	alice.expect("bob` has enter")
+
+	// 引用回复和投票都是多行消息，每一行都要带上前缀
+	alice.send("first")
+	bob.expect("alice: first")
+	alice.send("/quote 1 reply text")
+	lines := []string{bob.expect("> alice: first"), bob.expect("alice: reply text")}
+	bob.send(`/poll "去哪吃" 食堂 外卖`)
+	for _, want := range []string{"发起了投票", "投票：去哪吃", "1. 食堂", "2. 外卖"} {
+		lines = append(lines, bob.expect(want))
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "[") || !strings.Contains(line, "] ") {
+			t.Errorf("多行消息的一行没有前缀：%q", line)
+		}
+	}
+}
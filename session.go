@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// session 断线重连用的会话，通过随机生成的令牌找回昵称
+// 用户在线期间 ExpiresAt 为零值；断开后开始计时，超过 resumeTTL 未重连则失效，昵称在此期间为其保留。
+// 从没拿到过令牌的用户断开时会话直接删除，不占用昵称
+type session struct {
+	Nick      string
+	ExpiresAt time.Time
+}
+
+// sessions 重连令牌 -> 会话，只在 broadcaster 中读写
+type sessions map[string]*session
+
+// newResumeToken 生成不可猜测的重连令牌
+func newResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// expire 清理已经失效的会话
+func (s sessions) expire(now time.Time) {
+	for token, sess := range s {
+		if !sess.ExpiresAt.IsZero() && now.After(sess.ExpiresAt) {
+			delete(s, token)
+		}
+	}
+}
+
+// reserved 判断昵称是否正保留给某个断线待重连的用户
+func (s sessions) reserved(nick string) bool {
+	for _, sess := range s {
+		if sess.Nick == nick && !sess.ExpiresAt.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// release 删除为该昵称保留的会话，通过认证的昵称主人重新进入时调用
+func (s sessions) release(nick string) {
+	for token, sess := range s {
+		if sess.Nick == nick && !sess.ExpiresAt.IsZero() {
+			delete(s, token)
+		}
+	}
+}
+
+// lookup 查找令牌对应的会话，返回原来的昵称；令牌此时还不会作废，
+// 人数已满等原因拒绝进入时用户可以稍后再用同一个令牌重连
+func (s sessions) lookup(token string) (string, bool) {
+	sess, ok := s[token]
+	if !ok || sess.ExpiresAt.IsZero() {
+		// 不存在、已过期被清理，或者该会话仍在线（令牌只能属于一个连接）
+		return "", false
+	}
+	return sess.Nick, true
+}
+
+// consume 用户凭令牌重新登记成功后作废该令牌
+func (s sessions) consume(token string) {
+	delete(s, token)
+}
+
+// issue 为刚登记的用户签发新的令牌
+func (s sessions) issue(user *User) {
+	user.ResumeToken = newResumeToken()
+	s[user.ResumeToken] = &session{Nick: user.NickName}
+}
+
+// detach 用户断开后开始为其保留会话，令牌从没交给过客户端时没有人能用它重连，直接删除
+func (s sessions) detach(user *User, now time.Time) {
+	sess, ok := s[user.ResumeToken]
+	if !ok {
+		return
+	}
+	if !user.TokenShown.Load() {
+		delete(s, user.ResumeToken)
+		return
+	}
+	sess.ExpiresAt = now.Add(resumeTTL)
+}
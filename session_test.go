@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// fetchToken 通过 /token 取得重连令牌
+func fetchToken(t *testing.T, c *testClient) string {
+	t.Helper()
+	c.send("/token")
+	line := c.expect("重连令牌：")
+	token, _, _ := strings.Cut(strings.TrimPrefix(line, "重连令牌："), "，")
+	return token
+}
+
+func TestNickFreeWithoutToken(t *testing.T) {
+	ts := startServer(t)
+	carol := ts.join("carol")
+	alice := ts.join("alice")
+
+	// 没有取过令牌的会话断开后不保留昵称，立即可以重新使用
+	alice.close()
+	carol.expect("alice` has left")
+	ts.join("alice")
+}
+
+func TestTokenReservesNick(t *testing.T) {
+	ts := startServer(t)
+	carol := ts.join("carol")
+	alice := ts.join("alice")
+	token := fetchToken(t, alice)
+
+	alice.close()
+	carol.expect("alice` has left")
+
+	c := ts.connect("")
+	c.expect("请输入你的昵称")
+	c.send("alice")
+	c.expect("正保留给断线重连的用户")
+	c.send("/resume " + token)
+	c.expect("欢迎你的到来：alice")
+}
+
+func TestResumeAfterRoomFull(t *testing.T) {
+	setConfig(t, &maxUsers, 2)
+	ts := startServer(t)
+	carol := ts.join("carol")
+	alice := ts.join("alice")
+	token := fetchToken(t, alice)
+	alice.close()
+	carol.expect("alice` has left")
+	dave := ts.join("dave")
+
+	// 人数已满时拒绝重连，但令牌仍然有效
+	c := ts.connect("")
+	c.expect("请输入你的昵称")
+	c.send("/resume " + token)
+	c.expect("聊天室已满")
+
+	dave.close()
+	carol.expect("dave` has left")
+	c.send("/resume " + token)
+	c.expect("欢迎你的到来：alice")
+}
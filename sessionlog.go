@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 进出记录最多保留的条数，与聊天记录分开保存
+const sessionLogSize = 50
+
+// sessionEvent 一条进入或离开的记录
+type sessionEvent struct {
+	Time time.Time
+	Nick string
+	Join bool
+}
+
+// appendSessionLog 追加一条进出记录，超过 sessionLogSize 时丢弃最早的
+func appendSessionLog(events []sessionEvent, nick string, join bool) []sessionEvent {
+	events = append(events, sessionEvent{Time: time.Now(), Nick: nick, Join: join})
+	if len(events) > sessionLogSize {
+		events = events[len(events)-sessionLogSize:]
+	}
+	return events
+}
+
+// logCommand 处理 /log [n]，私下显示最近 n 条进出记录，不指定时显示全部
+func logCommand(user *User, args string) {
+	reply := make(chan []sessionEvent)
+	if !submit(user.srv, user.srv.sessionLogChannel, reply) {
+		return
+	}
+	events := <-reply
+
+	n := len(events)
+	if args != "" {
+		var err error
+		if n, err = strconv.Atoi(args); err != nil || n < 1 {
+			user.notify("用法：/log [n]")
+			return
+		}
+		n = min(n, len(events))
+	}
+	if n == 0 {
+		user.notify("暂无进出记录")
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("进出记录（最近 " + strconv.Itoa(n) + " 条）：")
+	for _, e := range events[len(events)-n:] {
+		action := "离开"
+		if e.Join {
+			action = "加入"
+		}
+		b.WriteString("\n" + e.Time.Format("15:04") + " " + e.Nick + " " + action)
+	}
+	user.notify(b.String())
+}
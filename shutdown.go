@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// 关闭服务时最多等待连接退出的时间
+const shutdownTimeout = 5 * time.Second
+
+// watchShutdown 收到 SIGINT/SIGTERM 后停止接受新连接并通知 broadcaster
+// 之后恢复信号的默认处理，再按一次 Ctrl+C 可以立即退出
+func watchShutdown(srv *Server, listener net.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+
+	infof("收到 %v，正在关闭服务", sig)
+	srv.shutdown()
+	listener.Close()
+}
+
+// shutdown 开始关闭服务，broadcaster 随之通知所有在线用户并退出，可以重复调用
+// 还停在昵称、密码提示的连接不归 broadcaster 管，由这里让它们阻塞的读操作立即返回
+// 调用方还需要关闭交给 serve 的 listener，再用 waitConns 等待连接退出
+func (s *Server) shutdown() {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.shuttingDown() {
+		return
+	}
+	close(s.shutdownChannel)
+	for conn := range s.pendingConns {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// trackConn 登记一个新连接，已经开始关闭时返回 false
+// 和 shutdown 互斥：否则 accept 之后、登记之前开始的 waitConns 可能在这个连接退出前就返回
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.shuttingDown() {
+		return false
+	}
+	s.activeConns.Add(1)
+	s.pendingConns[conn] = struct{}{}
+	return true
+}
+
+// admitConn 连接已经进入聊天室或登记为镜像，之后关闭服务时由 broadcaster 的 handleShutdown 通知并断开
+func (s *Server) admitConn(conn net.Conn) {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	delete(s.pendingConns, conn)
+}
+
+// untrackConn 连接处理完毕，和 trackConn 成对调用
+func (s *Server) untrackConn(conn net.Conn) {
+	s.connMutex.Lock()
+	delete(s.pendingConns, conn)
+	s.connMutex.Unlock()
+	s.activeConns.Done()
+}
+
+// shuttingDown 是否已经开始关闭服务
+func (s *Server) shuttingDown() bool {
+	select {
+	case <-s.shutdownChannel:
+		return true
+	default:
+		return false
+	}
+}
+
+// submit 把请求交给 broadcaster，broadcaster 已经退出时放弃并返回 false
+// 关闭服务时读 goroutine 可能还在处理最后一行输入，直接发送会永远阻塞，让 waitConns 等到超时
+func submit[T any](s *Server, ch chan<- T, v T) bool {
+	select {
+	case ch <- v:
+		return true
+	case <-s.broadcasterDone:
+		return false
+	}
+}
+
+// handleShutdown 在 broadcaster 退出前通知所有在线用户，并让阻塞在读操作上的读 goroutine 立即返回，走离开流程
+func (s *Server) handleShutdown(users map[*User]struct{}) {
+	for _, group := range []map[*User]struct{}{users, s.mirrors} {
+		for user := range group {
+			user.deliver(newNotice("服务器正在关闭"))
+			user.conn.SetReadDeadline(time.Now())
+			user.cancel()
+		}
+	}
+}
+
+// waitConns 等待所有连接退出，超时返回 false
+func (s *Server) waitConns(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.activeConns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
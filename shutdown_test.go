@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdownWhileClientsDisconnect(t *testing.T) {
+	ts := startServer(t)
+	var clients []*testClient
+	for i := 0; i < 10; i++ {
+		clients = append(clients, ts.join("user"+strconv.Itoa(i)))
+	}
+	// 还停在昵称提示上的连接不在 broadcaster 的列表里，也要立即断开，不能让关闭服务等到超时
+	idle := ts.connect("")
+	idle.expect("请输入你的昵称")
+
+	// 一半的客户端边发消息边断开，同时关闭服务，读 goroutine 在 broadcaster 退出前后都可能还在发送请求
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *testClient) {
+			defer wg.Done()
+			c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+			for j := 0; j < 20; j++ {
+				if _, err := io.WriteString(c.conn, "/roomstats\nmsg "+strconv.Itoa(j)+"\n"); err != nil {
+					return
+				}
+			}
+			if i%2 == 0 {
+				c.close()
+			}
+		}(i, c)
+	}
+
+	start := time.Now()
+	ts.stop()
+	if elapsed := time.Since(start); elapsed > shutdownTimeout {
+		t.Errorf("关闭服务用了 %v", elapsed)
+	}
+	wg.Wait()
+	idle.expectClosed()
+	for _, c := range clients {
+		c.expectClosed()
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"time"
+)
+
+// 发送队列满时的处理方式
+const (
+	// 丢弃消息，连续丢弃超过阈值后断开连接
+	slowPolicyDisconnect = "disconnect"
+	// 只丢弃消息，从不断开
+	slowPolicyDrop = "drop"
+)
+
+// deliver 由 broadcaster 调用，以非阻塞方式把消息放进用户的发送队列，避免一个不读数据的客户端拖住整个聊天室
+// 队列满时丢弃消息，并记录连续丢弃的条数和开始时间，超过 SLOW_CLIENT_MAX_DROPS 条或持续 SLOW_CLIENT_MAX_STALL 后断开连接
+func (u *User) deliver(msg *Message) {
+	select {
+	case u.MessageChannel <- msg:
+		u.drops = 0
+		return
+	default:
+	}
+
+	now := time.Now()
+	if u.drops == 0 {
+		u.dropSince = now
+	}
+	u.drops++
+	u.srv.slowDrops++
+	if u.kicked || slowClientPolicy == slowPolicyDrop {
+		return
+	}
+	if (slowClientMaxDrops > 0 && u.drops >= slowClientMaxDrops) ||
+		(slowClientMaxStall > 0 && now.Sub(u.dropSince) >= slowClientMaxStall) {
+		u.kicked = true
+		u.srv.slowKicks++
+		warnf("客户端接收过慢，断开连接：%s %s（连续丢弃 %d 条）", u.Addr, u.NickName, u.drops)
+		audit(u.Addr, "slow-disconnect", u.NickName)
+		go u.disconnect("连接过慢，已断开")
+	}
+}
+
+// tell 在 broadcaster 中给用户发送一条提示，和 deliver 一样不会阻塞；
+// broadcaster 给任何用户发送的内容都要经过 deliver 或 tell，读 goroutine 中给自己发提示使用 notify
+func (u *User) tell(text string) {
+	u.deliver(newNotice(text))
+}
+
+// disconnect 绕过已满的发送队列直接写出提示并关闭连接，读 goroutine 随之退出并走正常的离开流程
+// 对端多半已经不读数据，提示最多等 1 秒；压缩连接上无法单独插入明文，只关闭连接
+func (u *User) disconnect(reason string) {
+	u.cancel()
+	u.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if !u.deflating.Load() {
+		var buf bytes.Buffer
+		encodeMessage(&buf, u, newNotice(reason))
+		u.conn.Write(buf.Bytes())
+	}
+	u.conn.Close()
+}
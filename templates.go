@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// noticeData 系统提醒模板中可以使用的字段
+type noticeData struct {
+	// 用户昵称
+	Nick string
+	// 用户在线时长，如 1h2m3s
+	Duration string
+	// 当前时间，格式为 15:04:05
+	Time string
+}
+
+// lineData 广播行前后缀模板中可以使用的字段
+type lineData struct {
+	// 房间名，目前只有一个房间，固定为 main
+	Room string
+	// 广播序号，进入、离开提醒为 0
+	Seq int64
+}
+
+// 聊天室只有一个房间
+const roomName = "main"
+
+var (
+	joinTemplate    *template.Template
+	leaveTemplate   *template.Template
+	welcomeTemplate *template.Template
+
+	// 文本模式下每条广播前后附加的内容，供下游的日志解析程序使用，未配置时为 nil
+	linePrefixTemplate *template.Template
+	lineSuffixTemplate *template.Template
+)
+
+// parseTemplates 解析系统提醒模板，可以通过环境变量覆盖默认的措辞
+func parseTemplates() error {
+	var err error
+	if joinTemplate, err = parseTemplate("TEMPLATE_JOIN", "user:`{{.Nick}}` has enter"); err != nil {
+		return err
+	}
+	if leaveTemplate, err = parseTemplate("TEMPLATE_LEAVE", "user:`{{.Nick}}` has left"); err != nil {
+		return err
+	}
+	if welcomeTemplate, err = parseTemplate("TEMPLATE_WELCOME", "欢迎你的到来：{{.Nick}}"); err != nil {
+		return err
+	}
+	for _, line := range []struct {
+		key string
+		t   **template.Template
+	}{{"BROADCAST_PREFIX", &linePrefixTemplate}, {"BROADCAST_SUFFIX", &lineSuffixTemplate}} {
+		if os.Getenv(line.key) == "" {
+			continue
+		}
+		if *line.t, err = parseTemplateData(line.key, "", lineData{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseTemplate(key, def string) (*template.Template, error) {
+	return parseTemplateData(key, def, noticeData{})
+}
+
+// parseTemplateData 解析模板，sample 为该模板可以使用的数据类型
+func parseTemplateData(key, def string, sample any) (*template.Template, error) {
+	t, err := template.New(key).Option("missingkey=error").Parse(envString(key, def))
+	if err != nil {
+		return nil, fmt.Errorf("%s 模板格式错误：%w", key, err)
+	}
+	// 用示例数据渲染一次，提前发现引用了不存在字段等错误
+	if err := t.Execute(&strings.Builder{}, sample); err != nil {
+		return nil, fmt.Errorf("%s 模板渲染失败：%w", key, err)
+	}
+	return t, nil
+}
+
+// renderNotice 使用模板生成关于该用户的系统提醒
+func renderNotice(t *template.Template, user *User) string {
+	data := noticeData{
+		Nick:     user.NickName,
+		Duration: time.Since(user.EnterAt).Round(time.Second).String(),
+		Time:     time.Now().Format("15:04:05"),
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		errorf("渲染模板失败：%v", err)
+	}
+	return b.String()
+}
+
+// renderLine 生成广播行的前缀或后缀，未配置时返回空字符串
+func renderLine(t *template.Template, msg *Message) string {
+	if t == nil {
+		return ""
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, lineData{Room: roomName, Seq: msg.Seq}); err != nil {
+		errorf("渲染模板失败：%v", err)
+	}
+	return b.String()
+}
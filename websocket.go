@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// serveWebSocket 启动 WebSocket 网关，让浏览器也能加入聊天室
+// 每个 WebSocket 连接都包装成 net.Conn 交给 serveConn，和 TCP 连接共用同一套登记、广播和命令处理
+func (s *Server) serveWebSocket(addr string) {
+	server := websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			s.serveConn(&wsConn{Conn: ws, addr: wsAddr(ws.Request().RemoteAddr)})
+		},
+	}
+
+	log.Println("WebSocket 网关已启动：", addr)
+	if err := http.ListenAndServe(addr, server); err != nil {
+		errorf("WebSocket 网关退出：%v", err)
+	}
+}
+
+// wsAddr WebSocket 客户端的地址，websocket.Conn 的 RemoteAddr 返回的是 Origin，
+// 这里改用 HTTP 请求的来源地址，以便按 IP 做准入检查
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
+
+// wsConn 把 WebSocket 的文本帧转换成按行读写的连接：
+// 每收到一帧当作一行输入，每次写入作为一帧发送
+type wsConn struct {
+	*websocket.Conn
+	addr net.Addr
+	// 当前帧中尚未被读走的数据
+	buf []byte
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	if len(c.buf) == 0 {
+		var frame string
+		if err := websocket.Message.Receive(c.Conn, &frame); err != nil {
+			return 0, err
+		}
+		c.buf = []byte(strings.TrimRight(frame, "\r\n") + "\n")
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := websocket.Message.Send(c.Conn, strings.TrimSuffix(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+const helpText = `可用命令：
+gemini:<问题> - 询问 Google AI Gemini
+/msg <昵称> <内容> - 发送私信
+/away [留言]、/back - 设置/取消离开状态
+/quote <n> [回复] - 引用最近的第 n 条消息
+/shrug [内容] - 发送 ¯\_(ツ)_/¯
+/transcript [n] - 查看最近 n 条聊天记录
+/log [n] - 查看最近 n 条进出记录
+/roomstats - 查看聊天室统计
+/capacity - 查看人数上限（管理员可用 /capacity <n> 调整）
+/translate [-all] <语言> <文本> - 翻译
+/poll "问题" 选项1 选项2 ... - 发起投票，/vote <n> 投票，/poll-results 查看结果，/poll-close 结束
+/whois <昵称> - 查看用户信息
+/report <昵称> <原因> - 向管理员举报
+/plain [on|off]、/json on|off、/framing nul|newline - 切换输出格式
+/quiet - 屏蔽/恢复进入、离开提醒
+/welcome - 重新显示欢迎信息
+/token - 查看断线重连令牌
+/admin <密码> - 获取管理员权限
+管理员命令：/maintenance on|off、/slowmode <秒数>|off、/clearhistory、/debug、/loglevel [级别]、/pin <内容>|<序号>、/unpin、/setmotd [内容]、/migrate <主机:端口>`
+
+// 两次 /welcome 之间的最小间隔
+const welcomeCooldown = 10 * time.Second
+
+// loadMOTD 读取 MOTD 文件
+func loadMOTD(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// setMOTDCommand 处理管理员的 /setmotd [内容]，内容中的 \n 表示换行，为空时清除 MOTD；
+// 配置了 MOTD_FILE 时同时写入文件，重启后仍然有效
+func setMOTDCommand(user *User, args string) {
+	if !requireAdmin(user) {
+		return
+	}
+	motd := strings.TrimSpace(strings.ReplaceAll(args, `\n`, "\n"))
+	saved := true
+	if motdPath != "" {
+		if err := os.WriteFile(motdPath, []byte(motd+"\n"), 0o644); err != nil {
+			warnf("写入 MOTD 文件失败：%v", err)
+			saved = false
+		}
+	}
+	if !submit(user.srv, user.srv.motdChannel, motd) {
+		return
+	}
+	audit(user.Addr, "setmotd", user.NickName+" "+motd)
+	infof("%s 修改了 MOTD", user.NickName)
+
+	reply := "MOTD 已更新，之后进入的用户会看到：\n" + motd
+	if motd == "" {
+		reply = "MOTD 已清除"
+	}
+	if !saved {
+		reply += "\n（写入文件失败，重启后会恢复原内容）"
+	}
+	user.notify(reply)
+}
+
+// sendWelcome 在 broadcaster 中给用户发送欢迎信息、MOTD、置顶内容和帮助提示，进入聊天室和 /welcome 共用
+func sendWelcome(user *User, motd, pinned string) {
+	user.tell(renderNotice(welcomeTemplate, user))
+	if motd != "" {
+		user.tell(motd)
+	}
+	if pinned != "" {
+		user.tell("📌 置顶：" + pinned)
+	}
+	user.tell("输入 /help 查看可用命令")
+}
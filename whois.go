@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// whoisRequest 查询在线用户的信息
+type whoisRequest struct {
+	From *User
+	Nick string
+}
+
+// handleWhois 在 broadcaster 中查询用户信息，地址和客户端元数据只对管理员显示
+func handleWhois(users map[*User]struct{}, req whoisRequest) {
+	user := findUser(users, req.Nick)
+	if user == nil {
+		req.From.tell("用户 " + req.Nick + " 不在线")
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(user.NickName + "：在线 " + time.Since(user.EnterAt).Round(time.Second).String())
+	if user.Away {
+		b.WriteString("，暂时离开：" + user.AwayNote)
+	}
+	if user.IsAdmin.Load() {
+		b.WriteString("，管理员")
+	}
+	if req.From.IsAdmin.Load() {
+		b.WriteString("\n地址：" + user.Addr)
+		keys := make([]string, 0, len(user.Metadata))
+		for k := range user.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b.WriteString("\n" + k + "：" + user.Metadata[k])
+		}
+	}
+	req.From.tell(b.String())
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// 服务端不依赖运行环境的 locale，歧义宽度字符统一按 1 计算
+var widthCond = &runewidth.Condition{EastAsianWidth: false}
+
+// displayWidth 返回字符串在终端中的显示宽度：中日韩全角字符和 emoji 占 2，组合字符占 0
+func displayWidth(s string) int {
+	return widthCond.StringWidth(s)
+}
+
+// truncateDisplay 按显示宽度将 s 截断到不超过 max，并返回是否发生了截断
+// 组合字符跟随其前面的基础字符一起保留或丢弃，max <= 0 表示不限制
+func truncateDisplay(s string, max int) (string, bool) {
+	if max <= 0 || displayWidth(s) <= max {
+		return s, false
+	}
+
+	width := 0
+	for i, r := range s {
+		w := widthCond.RuneWidth(r)
+		if width+w > max {
+			// 避免在 emoji 组合序列中间截断后残留零宽连接符
+			return strings.TrimRight(s[:i], "\u200d"), true
+		}
+		width += w
+	}
+	return s, false
+}
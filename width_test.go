@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+// 组合字符和零宽连接符写成转义，避免被编辑器合成或隐藏
+const (
+	combiningE = "e\u0301"
+	familyZWJ  = "\U0001F468\u200d\U0001F469"
+)
+
+func TestDisplayWidth(t *testing.T) {
+	for s, want := range map[string]int{
+		"":                            0,
+		"alice":                       5,
+		"你好":                          4,
+		"ＡＢＣ":                         6,
+		"😀":                           2,
+		combiningE:                    1,
+		"a你😀":                         5,
+		combiningE + "t" + combiningE: 3,
+	} {
+		if got := displayWidth(s); got != want {
+			t.Errorf("displayWidth(%q) = %d，期望 %d", s, got, want)
+		}
+	}
+}
+
+func TestTruncateDisplay(t *testing.T) {
+	tests := []struct {
+		name      string
+		s         string
+		max       int
+		want      string
+		truncated bool
+	}{
+		{"不限制", "你好世界", 0, "你好世界", false},
+		{"ASCII", "alice_bob", 5, "alice", true},
+		{"刚好等于上限", "alice", 5, "alice", false},
+		{"中文不截成半个字", "你好世界", 5, "你好", true},
+		{"全角字母", "ＡＢＣ", 3, "Ａ", true},
+		{"emoji", "😀😀😀", 5, "😀😀", true},
+		{"emoji 不截成一半", "a😀", 2, "a", true},
+		{"组合字符跟随基础字符", combiningE + combiningE + combiningE, 2, combiningE + combiningE, true},
+		{"组合字符不计宽度", combiningE + combiningE, 2, combiningE + combiningE, false},
+		{"去掉残留的零宽连接符", familyZWJ, 3, "\U0001F468", true},
+		{"中英混合", "hi你好", 3, "hi", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated := truncateDisplay(tt.s, tt.max)
+			if got != tt.want || truncated != tt.truncated {
+				t.Errorf("truncateDisplay(%q, %d) = %q, %v，期望 %q, %v", tt.s, tt.max, got, truncated, tt.want, tt.truncated)
+			}
+			if tt.max > 0 && displayWidth(got) > tt.max {
+				t.Errorf("截断后宽度 %d 超过上限 %d", displayWidth(got), tt.max)
+			}
+		})
+	}
+}